@@ -105,13 +105,56 @@ const githubActionsRole = new aws.iam.Role("github-actions", {
     },
 }, { provider: defaultProvider });
 
+// S3 bucket holding the preview registry
+const stateBucket = new aws.s3.Bucket("preview-state", {
+    tags: {
+        Name: "Preview Environments State",
+    },
+}, { provider: defaultProvider });
+
+new aws.s3.BucketPublicAccessBlock("preview-state", {
+    bucket: stateBucket.id,
+    blockPublicAcls: true,
+    blockPublicPolicy: true,
+    ignorePublicAcls: true,
+    restrictPublicBuckets: true,
+}, { provider: defaultProvider });
+
+// Cached build outputs are only worth keeping while PRs are active
+new aws.s3.BucketLifecycleConfiguration("preview-state", {
+    bucket: stateBucket.id,
+    rules: [{
+        id: "expire-build-cache",
+        status: "Enabled",
+        filter: {
+            prefix: "build-cache/",
+        },
+        expiration: {
+            days: 30,
+        },
+    }],
+}, { provider: defaultProvider });
+
 // IAM Policy for GitHub Actions
 const githubActionsPolicy = new aws.iam.RolePolicy("github-actions-policy", {
     name: "GithubActionsPreviewPolicy",
     role: githubActionsRole.id,
-    policy: JSON.stringify({
+    policy: stateBucket.arn.apply(stateBucketArn => JSON.stringify({
         Version: "2012-10-17",
         Statement: [
+            {
+                Effect: "Allow",
+                Action: [
+                    "s3:ListBucket",
+                    "s3:GetObject",
+                    "s3:PutObject",
+                    "s3:DeleteObject",
+                ],
+                Resource: [
+                    stateBucketArn,
+                    `${stateBucketArn}/*`,
+                ],
+            },
             {
                 Effect: "Allow",
                 Action: [
@@ -127,7 +170,16 @@ const githubActionsPolicy = new aws.iam.RolePolicy("github-actions-policy", {
                     "s3:DeleteBucketPolicy",
                     "s3:GetBucketPolicy",
                     "s3:PutBucketPublicAccessBlock",
+                    "s3:GetBucketPublicAccessBlock",
+                    "s3:PutBucketOwnershipControls",
+                    "s3:GetBucketOwnershipControls",
+                    "s3:PutEncryptionConfiguration",
+                    "s3:GetEncryptionConfiguration",
+                    "s3:PutLifecycleConfiguration",
+                    "s3:GetLifecycleConfiguration",
                     "s3:GetBucketLocation",
+                    "s3:GetBucketTagging",
+                    "s3:PutBucketTagging",
                 ],
                 Resource: [
                     "arn:aws:s3:::pr-*",
@@ -150,13 +202,24 @@ const githubActionsPolicy = new aws.iam.RolePolicy("github-actions-policy", {
                     "cloudfront:ListDistributions",
                     "cloudfront:CreateInvalidation",
                     "cloudfront:GetInvalidation",
+                    "cloudfront:ListInvalidations",
                     "cloudfront:TagResource",
                     "cloudfront:UntagResource",
+                    "cloudfront:ListTagsForResource",
                     "cloudfront:ListOriginAccessControls",
                     "cloudfront:CreateOriginAccessControl",
                     "cloudfront:GetOriginAccessControl",
                     "cloudfront:UpdateOriginAccessControl",
                     "cloudfront:DeleteOriginAccessControl",
+                    "cloudfront:DescribeFunction",
+                    "cloudfront:CreateFunction",
+                    "cloudfront:PublishFunction",
+                    "cloudfront:ListFunctions",
+                    "cloudfront:DeleteFunction",
+                    "cloudfront:ListResponseHeadersPolicies",
+                    "cloudfront:CreateResponseHeadersPolicy",
+                    "cloudfront:GetResponseHeadersPolicy",
+                    "cloudfront:DeleteResponseHeadersPolicy",
                 ],
                 Resource: "*",
             },
@@ -172,6 +235,42 @@ const githubActionsPolicy = new aws.iam.RolePolicy("github-actions-policy", {
                 ],
                 Resource: "*",
             },
+            {
+                Effect: "Allow",
+                Action: [
+                    "wafv2:ListIPSets",
+                    "wafv2:GetIPSet",
+                    "wafv2:CreateIPSet",
+                    "wafv2:UpdateIPSet",
+                    "wafv2:ListWebACLs",
+                    "wafv2:GetWebACL",
+                    "wafv2:CreateWebACL",
+                ],
+                Resource: "*",
+            },
+            {
+                // Only keys tagged pr-preview=true can encrypt preview buckets (--kms-key-id).
+                Effect: "Allow",
+                Action: [
+                    "kms:GetKeyPolicy",
+                    "kms:PutKeyPolicy",
+                    "kms:GenerateDataKey",
+                    "kms:Decrypt",
+                ],
+                Resource: "*",
+                Condition: {
+                    StringEquals: {
+                        "aws:ResourceTag/pr-preview": "true",
+                    },
+                },
+            },
+            {
+                Effect: "Allow",
+                Action: [
+                    "secretsmanager:GetSecretValue",
+                ],
+                Resource: "arn:aws:secretsmanager:*:*:secret:pr-preview/*",
+            },
             {
                 Effect: "Allow",
                 Action: [
@@ -181,10 +280,11 @@ const githubActionsPolicy = new aws.iam.RolePolicy("github-actions-policy", {
                 Resource: "*",
             },
         ],
-    }),
+    })),
 }, { provider: defaultProvider });
 
 // Exports
 export const githubActionsRoleArn = githubActionsRole.arn;
 export const certificateArn = certificate.arn;
 export const baseDomainOutput = baseDomain;
+export const stateBucketName = stateBucket.bucket;
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/go-github/v66/github"
+)
+
+// perAppActions act on a single preview. Without --app they run once per app
+// when the config file defines several.
+var perAppActions = map[string]bool{
+	"deploy": true, "plan": true, "cleanup": true, "extend": true,
+	"sleep": true, "wake": true, "status": true,
+}
+
+// appResult is the outcome of one app of a multi-app run.
+type appResult struct {
+	pm  *PreviewManager
+	out *prefixWriter
+	// skipped says why the app was not run, e.g. because the PR does not
+	// change it.
+	skipped string
+	err     error
+}
+
+// RunApps runs the action for every app in parallel, each with its own
+// manager and its output prefixed with the app name. Deploys skip the apps
+// the PR does not change, and deploy and cleanup post one comment for all
+// apps instead of one per app.
+func (pm *PreviewManager) RunApps(ctx context.Context, apps []*Config) error {
+	var mu sync.Mutex
+	buildMus := make(map[string]*sync.Mutex)
+	results := make([]*appResult, len(apps))
+	for i, cfg := range apps {
+		out := &prefixWriter{mu: &mu, w: pm.out, prefix: fmt.Sprintf("[%s] ", cfg.AppName)}
+		app := newPreviewManager(cfg, pm.awsCfg, pm.githubClient, out)
+		app.summarized = cfg.Action == "deploy" || cfg.Action == "cleanup"
+		if cfg.BuildCommand != "" {
+			dir, err := filepath.Abs(cfg.BuildDir)
+			if err != nil {
+				return err
+			}
+			if buildMus[dir] == nil {
+				buildMus[dir] = &sync.Mutex{}
+			}
+			app.buildMu = buildMus[dir]
+		}
+		results[i] = &appResult{pm: app, out: out}
+	}
+
+	if pm.cfg.Action == "deploy" || pm.cfg.Action == "plan" {
+		pm.skipUnchangedApps(ctx, results)
+	}
+
+	var wg sync.WaitGroup
+	for _, result := range results {
+		run := result.pm.runAction
+		if result.skipped != "" {
+			// Skipped deploys keep the previous preview alive.
+			if pm.cfg.Action != "deploy" {
+				continue
+			}
+			run = func(ctx context.Context) error {
+				return result.pm.withLock(ctx, nil, result.pm.keepAlive)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer result.out.Flush()
+			result.err = run(ctx)
+			switch {
+			case errors.Is(result.err, errSuperseded):
+				fmt.Fprintln(result.out, "Deployment skipped: a newer commit will be deployed by another run")
+			case errors.Is(result.err, errNoPreview):
+				fmt.Fprintln(result.out, "Cleanup skipped: the preview was never deployed")
+			case result.err != nil:
+				fmt.Fprintf(result.out, "✗ %s failed: %v\n", result.pm.cfg.Action, result.err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Fprintln(pm.out, "\nApps:")
+	w := newTableWriter(pm.out)
+	fmt.Fprintln(w, "  APP\tURL\tRESULT")
+	var failed []string
+	for _, result := range results {
+		outcome := "ok"
+		switch {
+		case errors.Is(result.err, errSuperseded):
+			outcome = "skipped, superseded by a newer commit"
+		case errors.Is(result.err, errNoPreview):
+			outcome = "skipped, never deployed"
+		case result.err != nil:
+			outcome = "failed: " + result.err.Error()
+			failed = append(failed, result.pm.cfg.AppName)
+		case result.skipped != "":
+			outcome = "skipped, " + result.skipped
+		}
+		fmt.Fprintf(w, "  %s\thttps://%s\t%s\n", result.pm.cfg.AppName, result.pm.fullDomain, outcome)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	switch pm.cfg.Action {
+	case "deploy":
+		if err := pm.postAppsComment(ctx, results); err != nil {
+			fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
+		}
+	case "cleanup":
+		if err := pm.postAppsCleanupComment(ctx, results); err != nil {
+			fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d app(s) failed: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runAction runs the action of the preview as main does for a single app.
+func (pm *PreviewManager) runAction(ctx context.Context) error {
+	switch pm.cfg.Action {
+	case "deploy":
+		return pm.withLock(ctx, pm.checkSuperseded, pm.Deploy)
+	case "plan":
+		return pm.Plan(ctx)
+	case "cleanup":
+		return pm.withLock(ctx, nil, pm.Cleanup)
+	case "extend":
+		return pm.withLock(ctx, nil, pm.Extend)
+	case "sleep":
+		return pm.withLock(ctx, nil, pm.Sleep)
+	case "wake":
+		return pm.withLock(ctx, nil, pm.Wake)
+	case "status":
+		return pm.Status(ctx)
+	}
+	return fmt.Errorf("action %s does not run per app", pm.cfg.Action)
+}
+
+// skipUnchangedApps marks the apps the PR does not change, logging the
+// decision for every app.
+func (pm *PreviewManager) skipUnchangedApps(ctx context.Context, results []*appResult) {
+	files, ok := pm.changedFiles(ctx)
+	if !ok {
+		return
+	}
+	for _, result := range results {
+		result.skipped = result.pm.skipReason(files)
+	}
+}
+
+// postAppsComment posts one comment listing the preview of every app. It is
+// left to the newer run when a deploy was superseded.
+func (pm *PreviewManager) postAppsComment(ctx context.Context, results []*appResult) error {
+	if pm.githubClient == nil {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
+		return nil
+	}
+
+	var rows, notes []string
+	// previews counts the apps worth a comment, leaving out those the PR
+	// never deployed.
+	previews := 0
+	for _, result := range results {
+		app := result.pm
+		status := "✅ Deployed"
+		switch {
+		case errors.Is(result.err, errSuperseded):
+			fmt.Fprintln(pm.out, "Skipping GitHub comment (superseded by a newer commit)")
+			return nil
+		case result.err != nil:
+			status = fmt.Sprintf("❌ Failed: %s", result.err)
+			previews++
+		case result.skipped != "":
+			exists, err := app.bucketExists(ctx)
+			if err != nil {
+				return err
+			}
+			status = "⏭️ Not deployed, no changes"
+			if exists {
+				status = "⏭️ Unchanged, previous deploy kept"
+				previews++
+			}
+		default:
+			previews++
+			if appNotes := app.deployNotes(); len(appNotes) > 0 {
+				notes = append(notes, fmt.Sprintf("**%s**\n\n%s", app.cfg.AppName, strings.Join(appNotes, "\n\n")))
+			}
+		}
+		rows = append(rows, fmt.Sprintf("| %s | https://%s | %s |", app.cfg.AppName, app.fullDomain, status))
+	}
+	if previews == 0 {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (the PR changes no app)")
+		return nil
+	}
+
+	fmt.Fprintln(pm.out, "Posting GitHub PR comment...")
+
+	commentBody := fmt.Sprintf(`## Preview Environments 🚀
+
+| App | Preview | Status |
+|---|---|---|
+%s`, strings.Join(rows, "\n"))
+	if len(notes) > 0 {
+		commentBody += "\n\n" + strings.Join(notes, "\n\n")
+	}
+
+	return pm.upsertGitHubComment(ctx, commentBody)
+}
+
+// postAppsCleanupComment posts one cleanup comment for every app that had a
+// preview.
+func (pm *PreviewManager) postAppsCleanupComment(ctx context.Context, results []*appResult) error {
+	if pm.githubClient == nil {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
+		return nil
+	}
+
+	var rows []string
+	for _, result := range results {
+		if errors.Is(result.err, errNoPreview) {
+			continue
+		}
+		status := "🧹 Removed"
+		if result.err != nil {
+			status = fmt.Sprintf("❌ Failed: %s", result.err)
+		}
+		rows = append(rows, fmt.Sprintf("| %s | %s | %s |", result.pm.cfg.AppName, result.pm.fullDomain, status))
+	}
+	if len(rows) == 0 {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no app had a preview)")
+		return nil
+	}
+
+	fmt.Fprintln(pm.out, "Posting cleanup GitHub PR comment...")
+
+	comment := &github.IssueComment{
+		Body: github.String(fmt.Sprintf(`## Preview Environments Cleanup Complete 🧹
+
+The preview environments for PR #%d have been cleaned up.
+
+| App | Preview | Status |
+|---|---|---|
+%s`, pm.cfg.PRNumber, strings.Join(rows, "\n"))),
+	}
+
+	_, _, err := pm.githubClient.Issues.CreateComment(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber, comment)
+	if err != nil {
+		return fmt.Errorf("failed to create comment: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ GitHub PR comment posted")
+	return nil
+}
+
+func (pm *PreviewManager) bucketExists(ctx context.Context) (bool, error) {
+	_, err := pm.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(pm.bucketName),
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check bucket: %w", err)
+	}
+	return true, nil
+}
+
+// prefixWriter prefixes every line written to w, so the output of apps
+// running in parallel can be told apart. Writers sharing mu never
+// interleave within a line.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes what is left of an unterminated last line.
+func (p *prefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) > 0 {
+		fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf)
+		p.buf = nil
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// Auth modes.
+const (
+	authNone   = "none"
+	authBasic  = "basic"
+	authCookie = "cookie"
+)
+
+// authCookieName holds the token of an authenticated viewer in cookie mode.
+const authCookieName = "pr_preview_auth"
+
+// authCredential is one accepted username and password.
+type authCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// previewAuth holds the credentials accepted by the preview: the current
+// secret version and, during a rotation, the previous one.
+type previewAuth struct {
+	Mode        string
+	Credentials []authCredential
+}
+
+// loadAuth reads the AWSCURRENT and AWSPREVIOUS versions of the auth secret.
+// A secret is either {"username": "...", "password": "..."} or a plain
+// password, in which case the username is "preview".
+func (pm *PreviewManager) loadAuth(ctx context.Context) (*previewAuth, error) {
+	if pm.cfg.Auth == authNone {
+		return nil, nil
+	}
+
+	auth := &previewAuth{Mode: pm.cfg.Auth}
+	for _, stage := range []string{"AWSCURRENT", "AWSPREVIOUS"} {
+		result, err := pm.smClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId:     aws.String(pm.cfg.AuthSecret),
+			VersionStage: aws.String(stage),
+		})
+		var notFound *smtypes.ResourceNotFoundException
+		if stage == "AWSPREVIOUS" && errors.As(err, &notFound) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth secret (%s): %w", stage, err)
+		}
+
+		credential, err := parseAuthSecret(aws.ToString(result.SecretString))
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth secret %s (%s): %w", pm.cfg.AuthSecret, stage, err)
+		}
+		auth.Credentials = append(auth.Credentials, credential)
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ Loaded %s auth credentials (%d secret version(s))\n", auth.Mode, len(auth.Credentials))
+	return auth, nil
+}
+
+func parseAuthSecret(value string) (authCredential, error) {
+	credential := authCredential{Username: "preview", Password: value}
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		if err := json.Unmarshal([]byte(value), &credential); err != nil {
+			return credential, err
+		}
+		if credential.Username == "" {
+			credential.Username = "preview"
+		}
+	}
+	if credential.Password == "" {
+		return credential, fmt.Errorf("password is empty")
+	}
+	return credential, nil
+}
+
+// basicHeader is the Authorization header a browser sends for credential.
+func (c authCredential) basicHeader() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// cookieToken is the cookie value that proves the viewer knew the password.
+func (c authCredential) cookieToken() string {
+	return sha256Hex(c.Password)
+}
+
+// acceptedHashes returns what the function compares against. Only hashes are
+// embedded so the credentials cannot be read from the function code.
+func (a *previewAuth) acceptedHashes() []string {
+	var hashes []string
+	for _, c := range a.Credentials {
+		switch a.Mode {
+		case authBasic:
+			hashes = append(hashes, sha256Hex(c.basicHeader()))
+		case authCookie:
+			hashes = append(hashes, sha256Hex(c.cookieToken()))
+		}
+	}
+	return hashes
+}
+
+// authenticate adds the current credentials to a smoke test request.
+func (a *previewAuth) authenticate(req *http.Request) {
+	if a == nil || len(a.Credentials) == 0 {
+		return
+	}
+	switch a.Mode {
+	case authBasic:
+		req.Header.Set("Authorization", a.Credentials[0].basicHeader())
+	case authCookie:
+		req.AddCookie(&http.Cookie{Name: authCookieName, Value: a.Credentials[0].cookieToken()})
+	}
+}
+
+const basicAuthCode = `
+    var authorization = request.headers.authorization;
+    if (!authorization || accepted.indexOf(sha256(authorization.value)) === -1) {
+        return {
+            statusCode: 401,
+            statusDescription: 'Unauthorized',
+            headers: { 'www-authenticate': { value: 'Basic realm="Preview", charset="UTF-8"' } }
+        };
+    }
+`
+
+const cookieAuthCode = `
+    var token = request.querystring.preview_token;
+    if (token && accepted.indexOf(sha256(sha256(token.value))) !== -1) {
+        return {
+            statusCode: 302,
+            statusDescription: 'Found',
+            headers: { location: { value: request.uri } },
+            cookies: {
+                pr_preview_auth: {
+                    value: sha256(token.value),
+                    attributes: 'Path=/; Secure; HttpOnly; SameSite=Lax; Max-Age=604800'
+                }
+            }
+        };
+    }
+    var cookie = request.cookies.pr_preview_auth;
+    if (!cookie || accepted.indexOf(sha256(cookie.value)) === -1) {
+        return {
+            statusCode: 401,
+            statusDescription: 'Unauthorized',
+            headers: { 'content-type': { value: 'text/html; charset=utf-8' } },
+            body: {
+                encoding: 'text',
+                data: '<h1>Preview is protected</h1><p>Open this page with <code>?preview_token=&lt;password&gt;</code> to sign in.</p>'
+            }
+        };
+    }
+`
+
+// viewerRequestAuthCode returns the declarations and the handler statements
+// enforcing auth, or empty strings without auth.
+func viewerRequestAuthCode(auth *previewAuth) (string, string) {
+	if auth == nil {
+		return "", ""
+	}
+
+	var check string
+	switch auth.Mode {
+	case authBasic:
+		check = basicAuthCode
+	case authCookie:
+		check = cookieAuthCode
+	default:
+		return "", ""
+	}
+
+	accepted, _ := json.Marshal(auth.acceptedHashes())
+	declarations := fmt.Sprintf(`var crypto = require('crypto');
+
+var accepted = %s;
+
+function sha256(value) {
+    return crypto.createHash('sha256').update(value).digest('hex');
+}
+
+`, accepted)
+	return declarations, check
+}
+
+// authNote tells PR readers how the preview is protected without revealing
+// the credentials.
+func (pm *PreviewManager) authNote() string {
+	switch pm.cfg.Auth {
+	case authBasic:
+		return fmt.Sprintf("🔒 This preview is protected with HTTP basic auth. The credentials are in the `%s` secret.", pm.cfg.AuthSecret)
+	case authCookie:
+		return fmt.Sprintf("🔒 This preview is password protected. Open it with `?preview_token=<password>` once; the password is in the `%s` secret.", pm.cfg.AuthSecret)
+	}
+	return ""
+}
+
+func sha256Hex(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// abortMultipartRuleID is the lifecycle rule cleaning up incomplete
+// multipart uploads.
+const abortMultipartRuleID = "abort-incomplete-multipart-uploads"
+
+// denyInsecureTransportSid is the bucket policy statement rejecting
+// requests not made over TLS.
+const denyInsecureTransportSid = "DenyInsecureTransport"
+
+// md5MetadataKey holds the MD5 of an object's content. SSE-KMS objects have
+// ETags that are not the MD5, so change detection falls back to it.
+const md5MetadataKey = "md5"
+
+// headersTag holds a fingerprint of the Content-Type and Cache-Control of
+// every object of the last sync, so unchanged objects are only checked for
+// out of date headers when they may have changed.
+const headersTag = "preview:headers"
+
+// hardenBucket blocks public access, enforces bucket owner ownership, sets
+// default encryption and aborts incomplete multipart uploads. All calls are
+// idempotent, so existing buckets are brought in line on their next deploy.
+// Lifecycle rules added by others are kept, and the encryption is only
+// written when it differs.
+func (pm *PreviewManager) hardenBucket(ctx context.Context) error {
+	bucket := aws.String(pm.bucketName)
+
+	_, err := pm.s3Client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: bucket,
+		PublicAccessBlockConfiguration: &s3types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to block public access: %w", err)
+	}
+
+	_, err = pm.s3Client.PutBucketOwnershipControls(ctx, &s3.PutBucketOwnershipControlsInput{
+		Bucket: bucket,
+		OwnershipControls: &s3types.OwnershipControls{
+			Rules: []s3types.OwnershipControlsRule{
+				{ObjectOwnership: s3types.ObjectOwnershipBucketOwnerEnforced},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set ownership controls: %w", err)
+	}
+
+	if err := pm.ensureBucketEncryption(ctx); err != nil {
+		return err
+	}
+	if err := pm.ensureLifecycleRule(ctx); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ Bucket hardened (%s)\n", pm.encryptionName())
+	return nil
+}
+
+// ensureBucketEncryption sets the default encryption unless it already
+// matches.
+func (pm *PreviewManager) ensureBucketEncryption(ctx context.Context) error {
+	want := pm.encryptionRule()
+
+	current, err := pm.s3Client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{
+		Bucket: aws.String(pm.bucketName),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "ServerSideEncryptionConfigurationNotFoundError":
+	case err != nil:
+		return fmt.Errorf("failed to get default encryption: %w", err)
+	case current.ServerSideEncryptionConfiguration != nil && len(current.ServerSideEncryptionConfiguration.Rules) == 1 &&
+		encryptionRuleKey(current.ServerSideEncryptionConfiguration.Rules[0]) == encryptionRuleKey(want):
+		return nil
+	}
+
+	_, err = pm.s3Client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+		Bucket: aws.String(pm.bucketName),
+		ServerSideEncryptionConfiguration: &s3types.ServerSideEncryptionConfiguration{
+			Rules: []s3types.ServerSideEncryptionRule{want},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set default encryption: %w", err)
+	}
+	return nil
+}
+
+func encryptionRuleKey(rule s3types.ServerSideEncryptionRule) string {
+	var algorithm, keyID string
+	if rule.ApplyServerSideEncryptionByDefault != nil {
+		algorithm = string(rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm)
+		keyID = aws.ToString(rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID)
+	}
+	return fmt.Sprintf("%s:%s:%t", algorithm, keyID, aws.ToBool(rule.BucketKeyEnabled))
+}
+
+// ensureLifecycleRule adds the rule aborting incomplete multipart uploads to
+// the bucket's lifecycle configuration, replacing an outdated copy of it by
+// rule ID and keeping every other rule.
+func (pm *PreviewManager) ensureLifecycleRule(ctx context.Context) error {
+	want := s3types.LifecycleRule{
+		ID:     aws.String(abortMultipartRuleID),
+		Status: s3types.ExpirationStatusEnabled,
+		Filter: &s3types.LifecycleRuleFilter{Prefix: aws.String("")},
+		AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(1),
+		},
+	}
+
+	var rules []s3types.LifecycleRule
+	var minimumObjectSize s3types.TransitionDefaultMinimumObjectSize
+	current, err := pm.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(pm.bucketName),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration":
+	case err != nil:
+		return fmt.Errorf("failed to get lifecycle rules: %w", err)
+	default:
+		minimumObjectSize = current.TransitionDefaultMinimumObjectSize
+		for _, rule := range current.Rules {
+			if aws.ToString(rule.ID) != abortMultipartRuleID {
+				rules = append(rules, rule)
+				continue
+			}
+			if rule.Status == want.Status && rule.AbortIncompleteMultipartUpload != nil &&
+				aws.ToInt32(rule.AbortIncompleteMultipartUpload.DaysAfterInitiation) == 1 {
+				return nil
+			}
+		}
+	}
+
+	_, err = pm.s3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(pm.bucketName),
+		LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{
+			Rules: append(rules, want),
+		},
+		TransitionDefaultMinimumObjectSize: minimumObjectSize,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set lifecycle rules: %w", err)
+	}
+	return nil
+}
+
+func (pm *PreviewManager) encryptionRule() s3types.ServerSideEncryptionRule {
+	if pm.cfg.KMSKeyID == "" {
+		return s3types.ServerSideEncryptionRule{
+			ApplyServerSideEncryptionByDefault: &s3types.ServerSideEncryptionByDefault{
+				SSEAlgorithm: s3types.ServerSideEncryptionAes256,
+			},
+		}
+	}
+	return s3types.ServerSideEncryptionRule{
+		ApplyServerSideEncryptionByDefault: &s3types.ServerSideEncryptionByDefault{
+			SSEAlgorithm:   s3types.ServerSideEncryptionAwsKms,
+			KMSMasterKeyID: aws.String(pm.cfg.KMSKeyID),
+		},
+		// Bucket keys cut the KMS requests, and cost, of serving previews.
+		BucketKeyEnabled: aws.Bool(true),
+	}
+}
+
+func (pm *PreviewManager) encryptionName() string {
+	if pm.cfg.KMSKeyID == "" {
+		return "SSE-S3"
+	}
+	return "SSE-KMS"
+}
+
+// objectMD5 returns the MD5 recorded in the metadata of an object.
+func (pm *PreviewManager) objectMD5(ctx context.Context, key string) (string, error) {
+	result, err := pm.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(pm.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to head %s: %w", key, err)
+	}
+	return result.Metadata[md5MetadataKey], nil
+}
+
+// updateObjectHeaders copies an object onto itself with contentType and
+// cacheControl when its headers differ, keeping its metadata, and reports
+// whether they differed. Without apply it only compares them.
+func (pm *PreviewManager) updateObjectHeaders(ctx context.Context, key, contentType, cacheControl string, apply bool) (bool, error) {
+	head, err := pm.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(pm.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to head %s: %w", key, err)
+	}
+	if aws.ToString(head.ContentType) == contentType && aws.ToString(head.CacheControl) == cacheControl {
+		return false, nil
+	}
+	if !apply {
+		return true, nil
+	}
+
+	_, err = pm.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(pm.bucketName),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(pm.bucketName) + "/" + escapeKey(key)),
+		MetadataDirective: s3types.MetadataDirectiveReplace,
+		ContentType:       aws.String(contentType),
+		CacheControl:      optionalString(cacheControl),
+		Metadata:          head.Metadata,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to update headers of %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// escapeKey URL-encodes each segment of an object key for CopySource.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// kmsKeyPolicySid is the key policy statement letting CloudFront decrypt
+// preview objects. It covers every distribution of the account so one
+// statement serves all previews sharing the key.
+const kmsKeyPolicySid = "AllowCloudFrontPreviewDecrypt"
+
+// allowCloudFrontDecrypt merges the statement letting CloudFront read SSE-KMS
+// objects through OAC into the key policy.
+func (pm *PreviewManager) allowCloudFrontDecrypt(ctx context.Context, distributionARN string) error {
+	if pm.cfg.KMSKeyID == "" {
+		return nil
+	}
+
+	// arn:aws:cloudfront::{account}:distribution/{id}
+	parts := strings.Split(distributionARN, ":")
+	if len(parts) < 6 {
+		return fmt.Errorf("unexpected distribution ARN %s", distributionARN)
+	}
+	sourceARN := fmt.Sprintf("arn:%s:cloudfront::%s:distribution/*", parts[1], parts[4])
+
+	result, err := pm.kmsClient.GetKeyPolicy(ctx, &kms.GetKeyPolicyInput{
+		KeyId:      aws.String(pm.cfg.KMSKeyID),
+		PolicyName: aws.String("default"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get key policy: %w", err)
+	}
+
+	policy, err := parsePolicy(aws.ToString(result.Policy))
+	if err != nil {
+		return fmt.Errorf("failed to parse key policy: %w", err)
+	}
+
+	diff := policy.merge([]policyStatement{
+		{
+			Sid:       kmsKeyPolicySid,
+			Effect:    "Allow",
+			Principal: servicePrincipal("cloudfront.amazonaws.com"),
+			Action:    stringOrList{"kms:Decrypt"},
+			Resource:  stringOrList{"*"},
+			Condition: map[string]map[string]stringOrList{
+				"ArnLike": {"AWS:SourceArn": {sourceARN}},
+			},
+		},
+	})
+	if len(diff) == 0 {
+		return nil
+	}
+	pm.printPolicyDiff(diff)
+
+	_, err = pm.kmsClient.PutKeyPolicy(ctx, &kms.PutKeyPolicyInput{
+		KeyId:      aws.String(pm.cfg.KMSKeyID),
+		PolicyName: aws.String("default"),
+		Policy:     aws.String(policy.String()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update key policy: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ KMS key policy allows CloudFront to decrypt preview objects")
+	return nil
+}
+
+// isNotConfigured reports whether err is S3's answer for a bucket setting
+// that was never configured.
+func isNotConfigured(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "NoSuchPublicAccessBlockConfiguration", "OwnershipControlsNotFoundError",
+		"ServerSideEncryptionConfigurationNotFoundError", "NoSuchBucketPolicy", "NoSuchLifecycleConfiguration":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// buildCachePrefix holds the cached build outputs in the state bucket, as
+// {key}.tar.gz with the build log next to it as {key}.log.
+const buildCachePrefix = "build-cache/"
+
+// lockfileNames are the dependency lockfiles added to the build cache key,
+// looked up in the build directory and its parents up to the repository root.
+var lockfileNames = []string{
+	"package-lock.json", "npm-shrinkwrap.json", "yarn.lock", "pnpm-lock.yaml",
+	"bun.lock", "bun.lockb", "go.sum", "Gemfile.lock", "poetry.lock",
+	"Pipfile.lock", "Cargo.lock", "composer.lock",
+}
+
+// buildResult describes the build output deployed, for the deploy summary.
+type buildResult struct {
+	Key      string
+	Cached   bool
+	SHA      string
+	Duration time.Duration
+	Log      string
+}
+
+func (b *buildResult) String() string {
+	if b.Cached {
+		return fmt.Sprintf("cache hit %s, built in %s from %s", shortSHA(b.Key), b.Duration.Round(time.Second), shortSHA(b.SHA))
+	}
+	if b.Key != "" {
+		return fmt.Sprintf("built in %s, cached as %s", b.Duration.Round(time.Second), shortSHA(b.Key))
+	}
+	return fmt.Sprintf("built in %s", b.Duration.Round(time.Second))
+}
+
+// build runs --build-command to produce the source directory. With a state
+// bucket, the output of an earlier build with the same inputs is restored
+// instead, and a fresh build is added to the cache, except by a plan, which
+// changes nothing. Apps building in the same directory build one after
+// another.
+func (pm *PreviewManager) build(ctx context.Context) error {
+	if pm.cfg.BuildCommand == "" {
+		return nil
+	}
+	if pm.buildMu != nil {
+		pm.buildMu.Lock()
+		defer pm.buildMu.Unlock()
+	}
+	fmt.Fprintf(pm.out, "Building %s...\n", pm.cfg.SourcePath)
+
+	key := ""
+	if pm.cfg.BuildCache && pm.cfg.StateBucket != "" {
+		var err error
+		if key, err = pm.buildKey(ctx); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: Failed to compute build cache key, building without cache: %v\n", err)
+		}
+	}
+
+	if key != "" {
+		output, err := pm.checkBuildOutput(ctx)
+		if err != nil {
+			return err
+		}
+		result, err := pm.restoreBuild(ctx, key, output)
+		if err != nil {
+			fmt.Fprintf(pm.out, "  Warning: Failed to restore cached build: %v\n", err)
+		}
+		if result != nil {
+			pm.built = result
+			fmt.Fprintf(pm.out, "  ✓ Restored cached build %s, built from %s\n", shortSHA(key), shortSHA(result.SHA))
+			return nil
+		}
+	}
+
+	result, log, err := pm.runBuild(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(pm.out, "  ✓ Built in %s\n", result.Duration.Round(time.Second))
+
+	if key != "" && pm.cfg.Action != "plan" {
+		if err := pm.saveBuild(ctx, key, result, log); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: Failed to cache build: %v\n", err)
+		} else {
+			result.Key = key
+			result.Log = fmt.Sprintf("s3://%s/%s%s.log", pm.cfg.StateBucket, buildCachePrefix, key)
+			fmt.Fprintf(pm.out, "  ✓ Cached build as %s\n", shortSHA(key))
+		}
+	}
+
+	pm.built = result
+	return nil
+}
+
+// runBuild runs the build command in a shell, streaming its output and
+// returning it as the build log.
+func (pm *PreviewManager) runBuild(ctx context.Context) (*buildResult, []byte, error) {
+	fmt.Fprintf(pm.out, "  $ %s\n", pm.cfg.BuildCommand)
+
+	var log bytes.Buffer
+	out := &prefixWriter{mu: &sync.Mutex{}, w: pm.out, prefix: "  | "}
+	w := io.MultiWriter(&log, out)
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", pm.cfg.BuildCommand)
+	cmd.Dir = pm.cfg.BuildDir
+	cmd.Env = append(buildEnviron(os.Environ()), pm.cfg.BuildEnv...)
+	cmd.Stdout, cmd.Stderr = w, w
+
+	start := time.Now()
+	err := cmd.Run()
+	out.Flush()
+	duration := time.Since(start)
+	if err != nil {
+		return nil, nil, fmt.Errorf("build failed after %s: %w", duration.Round(time.Second), err)
+	}
+
+	if info, err := os.Stat(pm.cfg.SourcePath); err != nil || !info.IsDir() {
+		return nil, nil, fmt.Errorf("build did not produce %s", pm.cfg.SourcePath)
+	}
+
+	return &buildResult{SHA: pm.cfg.SHA, Duration: duration}, log.Bytes(), nil
+}
+
+// buildEnvDenyPrefixes are the variables withheld from the build command.
+// Install scripts and build scripts changed by the PR run with the build
+// environment, so it must not carry the deploy role's AWS credentials or
+// tokens that can write to the repository.
+var buildEnvDenyPrefixes = []string{"AWS_", "GITHUB_TOKEN", "GH_TOKEN", "ACTIONS_", envPrefix}
+
+// buildEnviron returns environ without the variables the build must not see.
+func buildEnviron(environ []string) []string {
+	return slices.DeleteFunc(slices.Clone(environ), func(env string) bool {
+		name, _, _ := strings.Cut(env, "=")
+		for _, prefix := range buildEnvDenyPrefixes {
+			if strings.HasPrefix(strings.ToUpper(name), prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// buildKey hashes the inputs of the build: the command, its environment, the
+// lockfiles, and the files matching the app and shared paths or inside the
+// build directory, except the output. Files are those git tracks or would
+// track, so ignored directories such as node_modules are left out.
+func (pm *PreviewManager) buildKey(ctx context.Context) (string, error) {
+	buildDir, err := filepath.Abs(pm.cfg.BuildDir)
+	if err != nil {
+		return "", err
+	}
+	output, err := filepath.Abs(pm.cfg.SourcePath)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := git(ctx, buildDir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+	root = strings.TrimSpace(root)
+
+	listed, err := git(ctx, root, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	if err != nil {
+		return "", err
+	}
+
+	relDir, err := filepath.Rel(root, buildDir)
+	if err != nil {
+		return "", err
+	}
+	relOutput, err := filepath.Rel(root, output)
+	if err != nil {
+		return "", err
+	}
+	relDir, relOutput = filepath.ToSlash(relDir), filepath.ToSlash(relOutput)
+
+	inputs := append(slices.Clone(pm.cfg.AppPaths), pm.cfg.SharedPaths...)
+	inputs = append(inputs, path.Join(relDir, "**"))
+	if relDir == "." {
+		inputs[len(inputs)-1] = "**"
+	}
+
+	lockfiles := make(map[string]bool)
+	for dir := relDir; ; dir = path.Dir(dir) {
+		for _, name := range lockfileNames {
+			lockfiles[path.Join(dir, name)] = true
+		}
+		if dir == "." {
+			break
+		}
+	}
+
+	var files []string
+	found := 0
+	for _, file := range strings.Split(listed, "\x00") {
+		if file == "" || file == relOutput || strings.HasPrefix(file, relOutput+"/") {
+			continue
+		}
+		if lockfiles[file] {
+			files = append(files, file)
+			found++
+			continue
+		}
+		for _, glob := range inputs {
+			if matchGlob(glob, file) {
+				files = append(files, file)
+				break
+			}
+		}
+	}
+	slices.Sort(files)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "command %q\ndir %s\noutput %s\n", pm.cfg.BuildCommand, relDir, relOutput)
+	for _, env := range slices.Sorted(slices.Values(pm.cfg.BuildEnv)) {
+		fmt.Fprintf(hash, "env %q\n", env)
+	}
+	for _, file := range files {
+		sum, err := hashFile(filepath.Join(root, filepath.FromSlash(file)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "file %s %s\n", file, sum)
+	}
+
+	key := hex.EncodeToString(hash.Sum(nil))
+	fmt.Fprintf(pm.out, "  Build cache key %s from %d lockfile(s) and %d source file(s)\n", shortSHA(key), found, len(files)-found)
+	return key, nil
+}
+
+// hashFile returns the SHA-256 of a file, or of the target of a symlink.
+func hashFile(name string) (string, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+
+	var data []byte
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		data = []byte(target)
+	case info.Mode().IsRegular():
+		if data, err = os.ReadFile(name); err != nil {
+			return "", err
+		}
+	default:
+		// Submodules are listed as directories.
+		return info.Mode().Type().String(), nil
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// restoreBuild replaces output, the source directory as returned by
+// checkBuildOutput, with the cached output of key. The cached output is
+// extracted next to it and renamed into place. It returns nil without an
+// error on a cache miss.
+func (pm *PreviewManager) restoreBuild(ctx context.Context, key, output string) (*buildResult, error) {
+	result, err := pm.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(pm.cfg.StateBucket),
+		Key:    aws.String(buildCachePrefix + key + ".tar.gz"),
+	})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		fmt.Fprintln(pm.out, "  Build cache miss")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cached build: %w", err)
+	}
+	defer result.Body.Close()
+
+	tmp, err := os.MkdirTemp(filepath.Dir(output), "."+filepath.Base(output)+"-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return nil, err
+	}
+	if err := extractTarGz(result.Body, tmp); err != nil {
+		return nil, fmt.Errorf("failed to extract cached build: %w", err)
+	}
+	if err := os.RemoveAll(output); err != nil {
+		return nil, fmt.Errorf("failed to clear %s: %w", pm.cfg.SourcePath, err)
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		return nil, fmt.Errorf("failed to move cached build into %s: %w", pm.cfg.SourcePath, err)
+	}
+
+	duration, _ := time.ParseDuration(result.Metadata["duration"])
+	return &buildResult{
+		Key:      key,
+		Cached:   true,
+		SHA:      result.Metadata["sha"],
+		Duration: duration,
+		Log:      fmt.Sprintf("s3://%s/%s%s.log", pm.cfg.StateBucket, buildCachePrefix, key),
+	}, nil
+}
+
+// checkBuildOutput returns the absolute source directory if restoring a
+// cached build may replace it: it must be inside the build directory and
+// must not contain the working directory, the config file directory or the
+// repository root.
+func (pm *PreviewManager) checkBuildOutput(ctx context.Context) (string, error) {
+	buildDir, err := filepath.Abs(pm.cfg.BuildDir)
+	if err != nil {
+		return "", err
+	}
+	output, err := filepath.Abs(pm.cfg.SourcePath)
+	if err != nil {
+		return "", err
+	}
+
+	var protected []string
+	if wd, err := os.Getwd(); err == nil {
+		protected = append(protected, wd)
+	}
+	if pm.cfg.ConfigPath != "" {
+		if configDir, err := filepath.Abs(filepath.Dir(pm.cfg.ConfigPath)); err == nil {
+			protected = append(protected, configDir)
+		}
+	}
+	if root, err := git(ctx, buildDir, "rev-parse", "--show-toplevel"); err == nil {
+		protected = append(protected, strings.TrimSpace(root))
+	}
+
+	if err := safeBuildOutput(buildDir, output, protected); err != nil {
+		return "", fmt.Errorf("refusing to replace %s: %w", pm.cfg.SourcePath, err)
+	}
+	return output, nil
+}
+
+// safeBuildOutput checks that output is strictly inside buildDir and
+// contains none of the protected directories. All paths are absolute.
+func safeBuildOutput(buildDir, output string, protected []string) error {
+	if output == buildDir || !within(buildDir, output) {
+		return fmt.Errorf("it is not inside the build directory %s", buildDir)
+	}
+	for _, dir := range protected {
+		if within(output, dir) {
+			return fmt.Errorf("it contains %s", dir)
+		}
+	}
+	return nil
+}
+
+// within reports whether target is dir or inside it.
+func within(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// saveBuild uploads the source directory and the build log under key.
+func (pm *PreviewManager) saveBuild(ctx context.Context, key string, result *buildResult, log []byte) error {
+	var archive bytes.Buffer
+	if err := writeTarGz(&archive, pm.cfg.SourcePath); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", pm.cfg.SourcePath, err)
+	}
+
+	_, err := pm.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(pm.cfg.StateBucket),
+		Key:         aws.String(buildCachePrefix + key + ".log"),
+		Body:        bytes.NewReader(log),
+		ContentType: aws.String("text/plain; charset=utf-8"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload build log: %w", err)
+	}
+
+	// The archive goes last, so a cache hit always has its log.
+	_, err = pm.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(pm.cfg.StateBucket),
+		Key:         aws.String(buildCachePrefix + key + ".tar.gz"),
+		Body:        bytes.NewReader(archive.Bytes()),
+		ContentType: aws.String("application/gzip"),
+		Metadata: map[string]string{
+			"duration": result.Duration.Round(time.Millisecond).String(),
+			"sha":      result.SHA,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload build output: %w", err)
+	}
+	return nil
+}
+
+// writeTarGz archives the regular files and directories below dir.
+func writeTarGz(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractTarGz extracts an archive written by writeTarGz into dir, rejecting
+// entries outside of it.
+func extractTarGz(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("invalid path in archive: %s", header.Name)
+		}
+		name := filepath.Join(dir, filepath.FromSlash(header.Name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(name, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
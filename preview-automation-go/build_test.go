@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBuildEnviron(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"HOME=/home/runner",
+		"AWS_ACCESS_KEY_ID=AKIA",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"AWS_SESSION_TOKEN=token",
+		"aws_profile=lower",
+		"GITHUB_TOKEN=ghs",
+		"GH_TOKEN=ghp",
+		"ACTIONS_ID_TOKEN_REQUEST_TOKEN=oidc",
+		"ACTIONS_RUNTIME_TOKEN=runtime",
+		"PR_PREVIEW_SCAN_KEY=key",
+		"GITHUB_SHA=abc",
+		"NODE_ENV=production",
+		"MY_AWS_REGION=kept",
+	}
+	want := []string{
+		"PATH=/usr/bin",
+		"HOME=/home/runner",
+		"GITHUB_SHA=abc",
+		"NODE_ENV=production",
+		"MY_AWS_REGION=kept",
+	}
+
+	got := buildEnviron(environ)
+	if !slices.Equal(got, want) {
+		t.Errorf("buildEnviron() = %q, want %q", got, want)
+	}
+	if len(environ) != 14 || environ[2] != "AWS_ACCESS_KEY_ID=AKIA" {
+		t.Errorf("buildEnviron() modified its input")
+	}
+}
+
+func TestSafeBuildOutput(t *testing.T) {
+	protected := []string{"/repo", "/repo/web-app"}
+	tests := []struct {
+		name     string
+		buildDir string
+		output   string
+		wantErr  bool
+	}{
+		{"inside", "/repo/web-app", "/repo/web-app/dist", false},
+		{"nested", "/repo/web-app", "/repo/web-app/build/out", false},
+		{"build dir itself", "/repo/web-app", "/repo/web-app", true},
+		{"outside", "/repo/web-app", "/repo/docs/dist", true},
+		{"parent", "/repo/web-app", "/repo", true},
+		{"sibling prefix", "/repo/web", "/repo/web-app/dist", true},
+		{"contains protected", "/", "/repo", true},
+		{"dot-dot name", "/repo/web-app", "/repo/web-app/..dist", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := safeBuildOutput(tt.buildDir, tt.output, protected)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("safeBuildOutput(%q, %q) error = %v, wantErr %v", tt.buildDir, tt.output, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+)
+
+// deployRef identifies one deploy of the preview: its name, the commit (or a
+// hash of the source directory when no --sha is given) and when the journal
+// was started. It stays the same when the SDK retries a request and when a
+// failed deploy is resumed from its journal, so CloudFront caller references
+// derived from it make creates idempotent, while every new deploy, e.g. a
+// re-run of the same commit or a preview recreated after cleanup, gets a
+// reference CloudFront has not seen.
+func (pm *PreviewManager) newDeployRef(journal *deployJournal) (string, error) {
+	version := pm.cfg.SHA
+	if version == "" {
+		hash, err := sourceHash(pm.cfg.SourcePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash source directory: %w", err)
+		}
+		version = hash
+	}
+	if len(version) > 12 {
+		version = version[:12]
+	}
+
+	return fmt.Sprintf("%s-%s-%d", pm.bucketName, version, journal.StartedAt.UnixMilli()), nil
+}
+
+// invalidationRef is the caller reference of an invalidation of paths, so
+// an invalidation adopted on InvalidationBatchAlreadyExists always has the
+// same paths.
+func (pm *PreviewManager) invalidationRef(paths []string) string {
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "%s\x00", p)
+	}
+	return fmt.Sprintf("invalidation-%s-%s", pm.deployRef, hex.EncodeToString(h.Sum(nil))[:12])
+}
+
+// sourceHash hashes the relative paths and contents of every file under dir.
+func sourceHash(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00", filepath.ToSlash(relPath))
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findDistributionByCallerReference returns the distribution created with
+// callerReference, looking at the preview alias first and then at every
+// distribution with the preview comment.
+func (pm *PreviewManager) findDistributionByCallerReference(ctx context.Context, callerReference, comment string) (string, error) {
+	distributionID, err := pm.findCloudFrontDistribution(ctx)
+	if err != nil || distributionID != "" {
+		return distributionID, err
+	}
+
+	distributions, err := pm.listDistributions(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dist := range distributions {
+		if aws.ToString(dist.Comment) != comment {
+			continue
+		}
+
+		distConfig, err := pm.cfClient.GetDistributionConfig(ctx, &cloudfront.GetDistributionConfigInput{
+			Id: dist.Id,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get distribution config: %w", err)
+		}
+		if aws.ToString(distConfig.DistributionConfig.CallerReference) == callerReference {
+			return aws.ToString(dist.Id), nil
+		}
+	}
+
+	return "", nil
+}
+
+// findInvalidationByCallerReference returns the invalidation of the
+// distribution created with callerReference, newest first.
+func (pm *PreviewManager) findInvalidationByCallerReference(ctx context.Context, distributionID, callerReference string) (string, error) {
+	paginator := cloudfront.NewListInvalidationsPaginator(pm.cfClient, &cloudfront.ListInvalidationsInput{
+		DistributionId: aws.String(distributionID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to list invalidations: %w", err)
+		}
+		if page.InvalidationList == nil {
+			break
+		}
+
+		for _, summary := range page.InvalidationList.Items {
+			invalidation, err := pm.cfClient.GetInvalidation(ctx, &cloudfront.GetInvalidationInput{
+				DistributionId: aws.String(distributionID),
+				Id:             summary.Id,
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to get invalidation: %w", err)
+			}
+			batch := invalidation.Invalidation.InvalidationBatch
+			if batch != nil && aws.ToString(batch.CallerReference) == callerReference {
+				return aws.ToString(summary.Id), nil
+			}
+		}
+	}
+
+	return "", nil
+}
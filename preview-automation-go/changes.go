@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// changedFiles returns the files the PR changes: the git diff between the
+// merge base of --base-sha and the deployed commit (--sha, default HEAD).
+// ok is false when there is nothing to diff against or the diff fails, in
+// which case every app is deployed.
+func (pm *PreviewManager) changedFiles(ctx context.Context) (files []string, ok bool) {
+	if pm.cfg.BaseSHA == "" {
+		fmt.Fprintln(pm.out, "Change detection: no --base-sha, deploying")
+		return nil, false
+	}
+
+	head := pm.cfg.SHA
+	if head == "" {
+		head = "HEAD"
+	}
+
+	// Paths are relative to the repository root wherever git runs, but it
+	// has to run inside the repository.
+	dir := "."
+	if pm.cfg.ConfigPath != "" {
+		dir = filepath.Dir(pm.cfg.ConfigPath)
+	}
+
+	// --no-renames lists both paths of a renamed file.
+	diff, err := git(ctx, dir, "diff", "--name-only", "--no-renames", pm.cfg.BaseSHA+"..."+head)
+	if err != nil {
+		fmt.Fprintf(pm.out, "Warning: Failed to diff %s...%s, deploying: %v\n", shortSHA(pm.cfg.BaseSHA), shortSHA(head), err)
+		return nil, false
+	}
+
+	files = strings.FieldsFunc(diff, func(r rune) bool { return r == '\n' })
+	fmt.Fprintf(pm.out, "Change detection: %d file(s) changed between %s and %s\n", len(files), shortSHA(pm.cfg.BaseSHA), shortSHA(head))
+	return files, true
+}
+
+// skipReason returns why the app need not be deployed for files, or "" when
+// a file matches one of its --app-path or --shared-path globs. Apps without
+// paths are always deployed.
+func (pm *PreviewManager) skipReason(files []string) string {
+	if len(pm.cfg.AppPaths) == 0 {
+		fmt.Fprintf(pm.out, "  %s: deploy, no app paths configured\n", pm.cfg.AppName)
+		return ""
+	}
+
+	for _, file := range files {
+		for _, glob := range pm.cfg.SharedPaths {
+			if matchGlob(glob, file) {
+				fmt.Fprintf(pm.out, "  %s: deploy, %s matches shared path %s\n", pm.cfg.AppName, file, glob)
+				return ""
+			}
+		}
+		for _, glob := range pm.cfg.AppPaths {
+			if matchGlob(glob, file) {
+				fmt.Fprintf(pm.out, "  %s: deploy, %s matches %s\n", pm.cfg.AppName, file, glob)
+				return ""
+			}
+		}
+	}
+
+	reason := "no changes in " + strings.Join(pm.cfg.AppPaths, ", ")
+	fmt.Fprintf(pm.out, "  %s: skip, %s\n", pm.cfg.AppName, reason)
+	return reason
+}
+
+// unchanged reports whether the PR leaves the app untouched, logging the
+// decision.
+func (pm *PreviewManager) unchanged(ctx context.Context) bool {
+	files, ok := pm.changedFiles(ctx)
+	return ok && pm.skipReason(files) != ""
+}
+
+// keepAlive renews the expiry of the preview of an app whose deploy is
+// skipped, so it lives as long as the previews of the apps the PR changes.
+func (pm *PreviewManager) keepAlive(ctx context.Context) error {
+	exists, err := pm.bucketExists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fmt.Fprintln(pm.out, "  No preview to keep alive")
+		return nil
+	}
+	if pm.cfg.TTL <= 0 {
+		fmt.Fprintln(pm.out, "  ✓ Previous deploy kept")
+		return nil
+	}
+
+	expiresAt, err := pm.renewExpiry(ctx, pm.cfg.TTL)
+	if err != nil {
+		return err
+	}
+	pm.expiresAt = expiresAt
+
+	err = pm.updateRecord(ctx, func(r *previewRecord) {
+		r.ExpiresAt = &expiresAt
+		r.TTL = formatDuration(pm.cfg.TTL)
+		r.ExpiryWarned = false
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update preview registry: %w", err)
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ Previous deploy kept, expires at %s\n", expiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// git runs a git command in dir and returns its output, with the first line of
+// stderr in the error.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		message, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, message)
+	}
+	return stdout.String(), nil
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
 	"github.com/aws/aws-sdk-go-v2/service/route53"
 	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -14,9 +16,39 @@ import (
 	"github.com/google/go-github/v66/github"
 )
 
+// errNoPreview is returned by a cleanup of a preview that was never
+// deployed, e.g. of an app the PR did not change.
+var errNoPreview = errors.New("no preview to clean up")
+
 func (pm *PreviewManager) Cleanup(ctx context.Context) error {
-	fmt.Println("Starting cleanup...")
+	fmt.Fprintln(pm.out, "Starting cleanup...")
 
+	bucketExists, err := pm.bucketExists(ctx)
+	if err != nil {
+		return err
+	}
+	distributionID, err := pm.findCloudFrontDistribution(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find distribution: %w", err)
+	}
+	if !bucketExists && distributionID == "" {
+		fmt.Fprintln(pm.out, "  No preview found")
+		return errNoPreview
+	}
+
+	if err := pm.teardown(ctx); err != nil {
+		return err
+	}
+
+	if err := pm.postCleanupGitHubComment(ctx); err != nil {
+		fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
+	}
+
+	return nil
+}
+
+// teardown removes every AWS resource belonging to the preview.
+func (pm *PreviewManager) teardown(ctx context.Context) error {
 	distributionID, err := pm.findCloudFrontDistribution(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to find distribution: %w", err)
@@ -27,48 +59,87 @@ func (pm *PreviewManager) Cleanup(ctx context.Context) error {
 			return fmt.Errorf("failed to delete CloudFront distribution: %w", err)
 		}
 	} else {
-		fmt.Println("  No CloudFront distribution found")
+		fmt.Fprintln(pm.out, "  No CloudFront distribution found")
 	}
 
-	if err := pm.deleteRoute53Record(ctx); err != nil {
-		fmt.Printf("  Warning: Failed to delete Route53 record: %v\n", err)
+	if err := pm.deleteRoute53Records(ctx); err != nil {
+		fmt.Fprintf(pm.out, "  Warning: Failed to delete Route53 records: %v\n", err)
 	}
 
 	if err := pm.deleteS3Bucket(ctx); err != nil {
 		return fmt.Errorf("failed to delete S3 bucket: %w", err)
 	}
 
-	if err := pm.postCleanupGitHubComment(ctx); err != nil {
-		fmt.Printf("Warning: Failed to post GitHub comment: %v\n", err)
+	// The OAC stays attached to a distribution that is only disabled, so
+	// asynchronous cleanups leave it for gc.
+	pendingDeletion := distributionID != "" && pm.cfg.AsyncDelete
+	if !pendingDeletion {
+		if err := pm.deleteOriginAccessControl(ctx); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: Failed to delete OAC: %v\n", err)
+		}
+	}
+
+	err = pm.updateRecord(ctx, func(r *previewRecord) {
+		if pendingDeletion {
+			r.Status = recordDeleting
+			r.DistributionID = distributionID
+			return
+		}
+		now := time.Now().UTC()
+		r.Status = recordDeleted
+		r.DeletedAt = &now
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update preview registry: %w", err)
+	}
+
+	if err := pm.deleteJournal(ctx); err != nil {
+		fmt.Fprintf(pm.out, "  Warning: %v\n", err)
 	}
 
 	return nil
 }
 
 func (pm *PreviewManager) deleteCloudFrontDistribution(ctx context.Context, distributionID string) error {
-	fmt.Printf("Deleting CloudFront distribution: %s\n", distributionID)
-
-	distConfig, err := pm.cfClient.GetDistributionConfig(ctx, &cloudfront.GetDistributionConfigInput{
-		Id: aws.String(distributionID),
+	fmt.Fprintf(pm.out, "Deleting CloudFront distribution: %s\n", distributionID)
+
+	fmt.Fprintln(pm.out, "  Disabling distribution...")
+	// The web ACL is shared with other previews, so it is detached here
+	// rather than deleted.
+	disabled, err := pm.updateDistributionConfig(ctx, distributionID, func(cfg *cftypes.DistributionConfig) bool {
+		changed := false
+		if aws.ToBool(cfg.Enabled) {
+			cfg.Enabled = aws.Bool(false)
+			changed = true
+		}
+		if aws.ToString(cfg.WebACLId) != "" {
+			cfg.WebACLId = aws.String("")
+			changed = true
+		}
+		return changed
 	})
 	if err != nil {
-		return fmt.Errorf("failed to get distribution config: %w", err)
+		return fmt.Errorf("failed to disable distribution: %w", err)
 	}
 
-	if *distConfig.DistributionConfig.Enabled {
-		fmt.Println("  Disabling distribution...")
-		distConfig.DistributionConfig.Enabled = aws.Bool(false)
-
-		_, err = pm.cfClient.UpdateDistribution(ctx, &cloudfront.UpdateDistributionInput{
-			Id:                 aws.String(distributionID),
-			DistributionConfig: distConfig.DistributionConfig,
-			IfMatch:            distConfig.ETag,
+	if pm.cfg.AsyncDelete {
+		dist, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+			Id: aws.String(distributionID),
 		})
 		if err != nil {
-			return fmt.Errorf("failed to disable distribution: %w", err)
+			return fmt.Errorf("failed to get distribution: %w", err)
+		}
+
+		if err := pm.markPendingDeletion(ctx, *dist.Distribution.ARN); err != nil {
+			return err
 		}
 
-		fmt.Println("  Waiting for distribution to be disabled...")
+		fmt.Fprintln(pm.out, "  ✓ Distribution disabled, it will be deleted by the next gc run")
+		return nil
+	}
+
+	if disabled {
+		fmt.Fprintln(pm.out, "  Waiting for distribution to be disabled...")
 		waiter := cloudfront.NewDistributionDeployedWaiter(pm.cfClient)
 		err = waiter.Wait(ctx, &cloudfront.GetDistributionInput{
 			Id: aws.String(distributionID),
@@ -78,86 +149,89 @@ func (pm *PreviewManager) deleteCloudFrontDistribution(ctx context.Context, dist
 		}
 	}
 
-	distConfig, err = pm.cfClient.GetDistributionConfig(ctx, &cloudfront.GetDistributionConfigInput{
-		Id: aws.String(distributionID),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to get updated distribution config: %w", err)
-	}
-
-	fmt.Println("  Deleting distribution...")
-	_, err = pm.cfClient.DeleteDistribution(ctx, &cloudfront.DeleteDistributionInput{
-		Id:      aws.String(distributionID),
-		IfMatch: distConfig.ETag,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to delete distribution: %w", err)
+	if err := pm.deleteDisabledDistribution(ctx, distributionID); err != nil {
+		return err
 	}
 
-	fmt.Println("  ✓ Distribution deleted")
+	fmt.Fprintln(pm.out, "  ✓ Distribution deleted")
 	return nil
 }
 
-func (pm *PreviewManager) deleteRoute53Record(ctx context.Context) error {
-	fmt.Println("Deleting Route53 DNS record...")
+// deleteDisabledDistribution deletes a distribution that has already been
+// disabled and finished deploying.
+func (pm *PreviewManager) deleteDisabledDistribution(ctx context.Context, distributionID string) error {
+	fmt.Fprintln(pm.out, "  Deleting distribution...")
+	return pm.retryOnConflict(ctx, "Distribution", func() error {
+		distConfig, err := pm.cfClient.GetDistributionConfig(ctx, &cloudfront.GetDistributionConfigInput{
+			Id: aws.String(distributionID),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get updated distribution config: %w", err)
+		}
+
+		_, err = pm.cfClient.DeleteDistribution(ctx, &cloudfront.DeleteDistributionInput{
+			Id:      aws.String(distributionID),
+			IfMatch: distConfig.ETag,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete distribution: %w", err)
+		}
+		return nil
+	})
+}
+
+func (pm *PreviewManager) deleteRoute53Records(ctx context.Context) error {
+	fmt.Fprintln(pm.out, "Deleting Route53 DNS records...")
 
 	hostedZoneID, err := pm.getHostedZoneID(ctx)
 	if err != nil {
 		return err
 	}
 
-	records, err := pm.r53Client.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
-		HostedZoneId:    aws.String(hostedZoneID),
-		StartRecordName: aws.String(pm.fullDomain),
-		StartRecordType: r53types.RRTypeCname,
-		MaxItems:        aws.Int32(1),
-	})
+	recordSets, err := pm.listPreviewRecordSets(ctx, hostedZoneID)
 	if err != nil {
-		return fmt.Errorf("failed to list records: %w", err)
+		return err
 	}
 
-	if len(records.ResourceRecordSets) == 0 {
-		fmt.Println("  No DNS record found")
+	if len(recordSets) == 0 {
+		fmt.Fprintln(pm.out, "  No DNS records found")
 		return nil
 	}
 
-	recordSet := records.ResourceRecordSets[0]
-	if *recordSet.Name != pm.fullDomain+"." {
-		fmt.Println("  No DNS record found")
-		return nil
+	var changes []r53types.Change
+	for _, recordSet := range recordSets {
+		changes = append(changes, r53types.Change{
+			Action:            r53types.ChangeActionDelete,
+			ResourceRecordSet: &recordSet,
+		})
 	}
 
 	_, err = pm.r53Client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
 		HostedZoneId: aws.String(hostedZoneID),
 		ChangeBatch: &r53types.ChangeBatch{
-			Changes: []r53types.Change{
-				{
-					Action:            r53types.ChangeActionDelete,
-					ResourceRecordSet: &recordSet,
-				},
-			},
+			Changes: changes,
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to delete DNS record: %w", err)
+		return fmt.Errorf("failed to delete DNS records: %w", err)
 	}
 
-	fmt.Println("  ✓ DNS record deleted")
+	fmt.Fprintf(pm.out, "  ✓ Deleted %d DNS record(s)\n", len(changes))
 	return nil
 }
 
 func (pm *PreviewManager) deleteS3Bucket(ctx context.Context) error {
-	fmt.Printf("Deleting S3 bucket: %s\n", pm.bucketName)
+	fmt.Fprintf(pm.out, "Deleting S3 bucket: %s\n", pm.bucketName)
 
 	_, err := pm.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(pm.bucketName),
 	})
 	if err != nil {
-		fmt.Println("  Bucket does not exist")
+		fmt.Fprintln(pm.out, "  Bucket does not exist")
 		return nil
 	}
 
-	fmt.Println("  Deleting all objects...")
+	fmt.Fprintln(pm.out, "  Deleting all objects...")
 	paginator := s3.NewListObjectsV2Paginator(pm.s3Client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(pm.bucketName),
 	})
@@ -195,36 +269,86 @@ func (pm *PreviewManager) deleteS3Bucket(ctx context.Context) error {
 		return fmt.Errorf("failed to delete bucket: %w", err)
 	}
 
-	fmt.Println("  ✓ Bucket deleted")
+	fmt.Fprintln(pm.out, "  ✓ Bucket deleted")
+	return nil
+}
+
+func (pm *PreviewManager) deleteOriginAccessControl(ctx context.Context) error {
+	oacName := pm.oacName()
+	fmt.Fprintf(pm.out, "Deleting Origin Access Control: %s\n", oacName)
+
+	oacs, err := pm.listOriginAccessControls(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, oac := range oacs {
+		if *oac.Name != oacName {
+			continue
+		}
+
+		err := pm.retryOnConflict(ctx, "OAC", func() error {
+			result, err := pm.cfClient.GetOriginAccessControl(ctx, &cloudfront.GetOriginAccessControlInput{
+				Id: oac.Id,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to get OAC: %w", err)
+			}
+
+			_, err = pm.cfClient.DeleteOriginAccessControl(ctx, &cloudfront.DeleteOriginAccessControlInput{
+				Id:      oac.Id,
+				IfMatch: result.ETag,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to delete OAC: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(pm.out, "  ✓ OAC deleted")
+		return nil
+	}
+
+	fmt.Fprintln(pm.out, "  No OAC found")
 	return nil
 }
 
 func (pm *PreviewManager) postCleanupGitHubComment(ctx context.Context) error {
+	if pm.summarized {
+		return nil
+	}
 	if pm.githubClient == nil {
-		fmt.Println("Skipping GitHub comment (no GitHub token provided)")
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
 		return nil
 	}
 
-	fmt.Println("Posting cleanup GitHub PR comment...")
+	fmt.Fprintln(pm.out, "Posting cleanup GitHub PR comment...")
 
-	commentBody := fmt.Sprintf(`## Preview Environment Cleanup Complete 🧹
+	distributionNote := "CloudFront distribution"
+	if pm.cfg.AsyncDelete {
+		distributionNote = "CloudFront distribution (disabled now, deleted by the next scheduled gc run)"
+	}
 
-The preview environment for PR #%d has been successfully cleaned up.
+	data := pm.commentData()
+	data.Resources = []string{distributionNote, "Route53 DNS records", "S3 bucket and contents"}
 
-All resources have been removed:
-- CloudFront distribution
-- Route53 DNS records
-- S3 bucket and contents`, pm.cfg.PRNumber)
+	commentBody, err := renderComment(pm.cfg.CleanupComment, defaultCleanupComment, data)
+	if err != nil {
+		return err
+	}
 
 	comment := &github.IssueComment{
 		Body: github.String(commentBody),
 	}
 
-	_, _, err := pm.githubClient.Issues.CreateComment(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber, comment)
+	_, _, err = pm.githubClient.Issues.CreateComment(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber, comment)
 	if err != nil {
 		return fmt.Errorf("failed to create comment: %w", err)
 	}
 
-	fmt.Println("  ✓ GitHub PR comment posted")
+	fmt.Fprintln(pm.out, "  ✓ GitHub PR comment posted")
 	return nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v66/github"
+)
+
+// commentMarker identifies the preview comment for this app so later runs
+// update it in place instead of adding a new comment on every push. A
+// multi-app run has no app and posts one comment for all of them.
+func (pm *PreviewManager) commentMarker() string {
+	if pm.cfg.AppName == "" {
+		return "<!-- pr-preview -->"
+	}
+	return fmt.Sprintf("<!-- pr-preview:%s -->", pm.cfg.AppName)
+}
+
+// upsertGitHubComment edits the existing preview comment on the PR, or
+// creates it if there is none yet.
+func (pm *PreviewManager) upsertGitHubComment(ctx context.Context, body string) error {
+	marker := pm.commentMarker()
+	comment := &github.IssueComment{
+		Body: github.String(marker + "\n" + body),
+	}
+
+	existingID, err := pm.findGitHubComment(ctx, marker)
+	if err != nil {
+		return err
+	}
+
+	if existingID != 0 {
+		_, _, err = pm.githubClient.Issues.EditComment(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, existingID, comment)
+		if err != nil {
+			return fmt.Errorf("failed to update comment: %w", err)
+		}
+		fmt.Fprintln(pm.out, "  ✓ GitHub PR comment updated")
+		return nil
+	}
+
+	_, _, err = pm.githubClient.Issues.CreateComment(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber, comment)
+	if err != nil {
+		return fmt.Errorf("failed to create comment: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ GitHub PR comment posted")
+	return nil
+}
+
+func (pm *PreviewManager) findGitHubComment(ctx context.Context, marker string) (int64, error) {
+	opts := &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	for {
+		comments, resp, err := pm.githubClient.Issues.ListComments(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber, opts)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list comments: %w", err)
+		}
+
+		for _, comment := range comments {
+			if strings.Contains(comment.GetBody(), marker) {
+				return comment.GetID(), nil
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return 0, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to a flag name, upper-cased with dashes turned into
+// underscores, to get the environment variable overriding it, e.g.
+// PR_PREVIEW_STATE_BUCKET for --state-bucket.
+const envPrefix = "PR_PREVIEW_"
+
+// appNamePattern matches the app names previewName accepts.
+var appNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// fileConfig is the format of the --config file, described by
+// preview.schema.json. Each setting stands for the flag named in its comment.
+type fileConfig struct {
+	Region        string               `yaml:"region"`        // --region
+	Domain        string               `yaml:"domain"`        // --domain
+	Certificate   string               `yaml:"certificate"`   // --cert
+	HostedZoneID  string               `yaml:"hostedZoneId"`  // --hosted-zone-id
+	PrivateZone   *bool                `yaml:"privateZone"`   // --private-zone
+	StateBucket   string               `yaml:"stateBucket"`   // --state-bucket
+	RegistryTable string               `yaml:"registryTable"` // --registry-table
+	TTL           string               `yaml:"ttl"`           // --ttl
+	MaxAge        string               `yaml:"maxAge"`        // --max-age
+	Routing       string               `yaml:"routing"`       // --routing
+	Auth          authConfig           `yaml:"auth"`
+	AllowCIDRs    []string             `yaml:"allowCidrs"` // --allow-cidr
+	Cache         []cacheRule          `yaml:"cache"`      // --cache-rule
+	Comments      commentTemplates     `yaml:"comments"`
+	Shared        []string             `yaml:"shared"` // --shared-path
+	Apps          map[string]appConfig `yaml:"apps"`
+}
+
+// appConfig holds the settings of one app, overriding the top-level ones.
+type appConfig struct {
+	Source  string      `yaml:"source"` // --source, relative to the config file
+	Paths   []string    `yaml:"paths"`  // --app-path, default the parent of source
+	Domain  string      `yaml:"domain"`
+	Routing string      `yaml:"routing"`
+	Auth    authConfig  `yaml:"auth"`
+	TTL     string      `yaml:"ttl"`
+	Cache   []cacheRule `yaml:"cache"`
+	Build   buildConfig `yaml:"build"`
+}
+
+// buildConfig is the build stage of an app. Dir is relative to the config
+// file and Output to Dir; the output replaces the app source.
+type buildConfig struct {
+	Command string            `yaml:"command"` // --build-command
+	Dir     string            `yaml:"dir"`     // --build-dir, default the config file directory
+	Env     map[string]string `yaml:"env"`     // --build-env
+	Output  string            `yaml:"output"`  // --source
+}
+
+type authConfig struct {
+	Mode   string `yaml:"mode"`   // --auth
+	Secret string `yaml:"secret"` // --auth-secret
+}
+
+type commentTemplates struct {
+	Deployed string `yaml:"deployed"` // --deployed-comment
+	Cleanup  string `yaml:"cleanup"`  // --cleanup-comment
+}
+
+// cacheRule sets the Cache-Control header of the uploaded files matching
+// Path, a glob matched against the object key or the file name.
+type cacheRule struct {
+	Path         string `yaml:"path"`
+	CacheControl string `yaml:"cacheControl"`
+}
+
+// fileSetting is a flag value taken from the config file. Key locates it in
+// the file for error messages.
+type fileSetting struct {
+	Key    string
+	Flag   string
+	Values []string
+}
+
+// loadSettings fills the flags not given on the command line from the
+// PR_PREVIEW_* environment variables, then from the --config file. Empty
+// variables count as unset, and repeatable flags take one value per line.
+// It returns the config file, or nil without one.
+func loadSettings(flags *flag.FlagSet, cfg *Config) (*fileConfig, error) {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value := os.Getenv(name)
+		if set[f.Name] || value == "" {
+			return
+		}
+		set[f.Name] = true
+
+		values := []string{value}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			values = strings.FieldsFunc(value, func(r rune) bool { return r == '\n' })
+		}
+		for _, v := range values {
+			if err := flags.Set(f.Name, strings.TrimSpace(v)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if cfg.ConfigPath == "" {
+		return nil, nil
+	}
+
+	file, err := readConfigFile(cfg.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := file.settings(cfg.AppName, filepath.Dir(cfg.ConfigPath))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.ConfigPath, err)
+	}
+	for _, setting := range settings {
+		if set[setting.Flag] {
+			continue
+		}
+		for _, value := range setting.Values {
+			if err := flags.Set(setting.Flag, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", cfg.ConfigPath, setting.Key, err))
+			}
+		}
+	}
+	return file, errors.Join(errs...)
+}
+
+// readConfigFile decodes the config file, rejecting unknown keys.
+func readConfigFile(configPath string) (*fileConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	file := &fileConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %w", configPath, err)
+	}
+	return file, nil
+}
+
+// settings returns the flag values of the file for appName. With a single
+// app defined, appName may be empty and that app is used.
+func (c *fileConfig) settings(appName, dir string) ([]fileSetting, error) {
+	for name, app := range c.Apps {
+		if !appNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("apps.%s: app names may only contain lowercase letters, digits and dashes", name)
+		}
+		for i, rule := range app.Cache {
+			if err := rule.validate(); err != nil {
+				return nil, fmt.Errorf("apps.%s.cache[%d]: %w", name, i, err)
+			}
+		}
+	}
+	for i, rule := range c.Cache {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("cache[%d]: %w", i, err)
+		}
+	}
+
+	settings := []fileSetting{
+		{"region", "region", []string{c.Region}},
+		{"domain", "domain", []string{c.Domain}},
+		{"certificate", "cert", []string{c.Certificate}},
+		{"hostedZoneId", "hosted-zone-id", []string{c.HostedZoneID}},
+		{"stateBucket", "state-bucket", []string{c.StateBucket}},
+		{"registryTable", "registry-table", []string{c.RegistryTable}},
+		{"ttl", "ttl", []string{c.TTL}},
+		{"maxAge", "max-age", []string{c.MaxAge}},
+		{"routing", "routing", []string{c.Routing}},
+		{"auth.mode", "auth", []string{c.Auth.Mode}},
+		{"auth.secret", "auth-secret", []string{c.Auth.Secret}},
+		{"allowCidrs", "allow-cidr", c.AllowCIDRs},
+		{"cache", "cache-rule", cacheRuleFlags(c.Cache)},
+		{"comments.deployed", "deployed-comment", []string{c.Comments.Deployed}},
+		{"comments.cleanup", "cleanup-comment", []string{c.Comments.Cleanup}},
+		{"shared", "shared-path", c.Shared},
+	}
+	if c.PrivateZone != nil {
+		settings = append(settings, fileSetting{"privateZone", "private-zone", []string{strconv.FormatBool(*c.PrivateZone)}})
+	}
+
+	if len(c.Apps) > 0 {
+		names := c.appNames()
+		if appName == "" && len(names) == 1 {
+			appName = names[0]
+			settings = append(settings, fileSetting{"apps", "app", []string{appName}})
+		}
+		if appName != "" {
+			app, ok := c.Apps[appName]
+			if !ok {
+				return nil, fmt.Errorf("app %q is not defined (apps: %s)", appName, strings.Join(names, ", "))
+			}
+
+			// App settings replace the top-level ones for the same flag.
+			prefix := "apps." + appName + "."
+
+			source, sourceKey := app.Source, prefix+"source"
+			if app.Build.Output != "" {
+				if app.Source != "" {
+					return nil, fmt.Errorf("%sbuild.output: the build output replaces source, set only one of them", prefix)
+				}
+				source, sourceKey = path.Join(filepath.ToSlash(app.Build.Dir), filepath.ToSlash(app.Build.Output)), prefix+"build.output"
+			}
+
+			paths := app.Paths
+			if len(paths) == 0 && source != "" {
+				paths = []string{path.Join(path.Dir(filepath.ToSlash(source)), "**")}
+			}
+
+			if source != "" && !filepath.IsAbs(source) {
+				source = filepath.Join(dir, source)
+			}
+
+			var build []fileSetting
+			if app.Build.Command != "" {
+				buildDir := app.Build.Dir
+				if !filepath.IsAbs(buildDir) {
+					buildDir = filepath.Join(dir, buildDir)
+				}
+				var env []string
+				for _, name := range slices.Sorted(maps.Keys(app.Build.Env)) {
+					env = append(env, name+"="+app.Build.Env[name])
+				}
+				build = []fileSetting{
+					{prefix + "build.command", "build-command", []string{app.Build.Command}},
+					{prefix + "build.dir", "build-dir", []string{buildDir}},
+					{prefix + "build.env", "build-env", env},
+				}
+			}
+
+			settings = append(settings, build...)
+			settings = append(settings,
+				fileSetting{sourceKey, "source", []string{source}},
+				fileSetting{prefix + "paths", "app-path", paths},
+				fileSetting{prefix + "domain", "domain", []string{app.Domain}},
+				fileSetting{prefix + "routing", "routing", []string{app.Routing}},
+				fileSetting{prefix + "auth.mode", "auth", []string{app.Auth.Mode}},
+				fileSetting{prefix + "auth.secret", "auth-secret", []string{app.Auth.Secret}},
+				fileSetting{prefix + "ttl", "ttl", []string{app.TTL}},
+				fileSetting{prefix + "cache", "cache-rule", cacheRuleFlags(app.Cache)},
+			)
+		}
+	}
+
+	// Drop unset values, then keep the last setting of each flag.
+	var result []fileSetting
+	for _, setting := range settings {
+		setting.Values = slices.DeleteFunc(setting.Values, func(v string) bool { return v == "" })
+		if len(setting.Values) == 0 {
+			continue
+		}
+		result = slices.DeleteFunc(result, func(s fileSetting) bool { return s.Flag == setting.Flag })
+		result = append(result, setting)
+	}
+	return result, nil
+}
+
+// appNames returns the names of the apps in the file, sorted.
+func (c *fileConfig) appNames() []string {
+	names := make([]string, 0, len(c.Apps))
+	for name := range c.Apps {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (r cacheRule) validate() error {
+	if r.Path == "" || r.CacheControl == "" {
+		return errors.New("path and cacheControl are required")
+	}
+	_, err := parseCacheRule(r.Path + "=" + r.CacheControl)
+	return err
+}
+
+func cacheRuleFlags(rules []cacheRule) []string {
+	var values []string
+	for _, rule := range rules {
+		values = append(values, rule.Path+"="+rule.CacheControl)
+	}
+	return values
+}
+
+// parseCacheRules turns "glob=Cache-Control value" flags into cache rules.
+func parseCacheRules(values []string) ([]cacheRule, error) {
+	rules := make([]cacheRule, 0, len(values))
+	for _, value := range values {
+		rule, err := parseCacheRule(value)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseCacheRule(value string) (cacheRule, error) {
+	pattern, cacheControl, ok := strings.Cut(value, "=")
+	pattern, cacheControl = strings.TrimSpace(pattern), strings.TrimSpace(cacheControl)
+	if !ok || pattern == "" || cacheControl == "" {
+		return cacheRule{}, fmt.Errorf("invalid cache rule %q, expected \"glob=Cache-Control value\"", value)
+	}
+	if err := validateGlob(pattern); err != nil {
+		return cacheRule{}, fmt.Errorf("invalid cache rule glob %q: %w", pattern, err)
+	}
+	return cacheRule{Path: pattern, CacheControl: cacheControl}, nil
+}
+
+// cacheControl returns the Cache-Control value of the first rule matching
+// key, or "" to send none.
+func cacheControl(rules []cacheRule, key string) string {
+	for _, rule := range rules {
+		if matchGlob(rule.Path, key) || matchGlob(rule.Path, path.Base(key)) {
+			return rule.CacheControl
+		}
+	}
+	return ""
+}
+
+// matchGlob is path.Match with "**" matching any number of directories.
+func matchGlob(pattern, name string) bool {
+	patternParts, nameParts := strings.Split(pattern, "/"), strings.Split(name, "/")
+
+	var match func(p, n int) bool
+	match = func(p, n int) bool {
+		if p == len(patternParts) {
+			return n == len(nameParts)
+		}
+		if patternParts[p] == "**" {
+			for i := n; i <= len(nameParts); i++ {
+				if match(p+1, i) {
+					return true
+				}
+			}
+			return false
+		}
+		if n == len(nameParts) {
+			return false
+		}
+		matched, _ := path.Match(patternParts[p], nameParts[n])
+		return matched && match(p+1, n+1)
+	}
+	return match(0, 0)
+}
+
+func validateGlob(pattern string) error {
+	for _, part := range strings.Split(pattern, "/") {
+		if _, err := path.Match(part, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commentData is what comment templates can refer to.
+type commentData struct {
+	App string
+	PR  int
+	URL string
+	SHA string
+	// Notes are the deployed comment's paragraphs about smoke tests, auth,
+	// expiry and propagation.
+	Notes []string
+	// Resources are the resources the cleanup comment reports as removed.
+	Resources []string
+}
+
+const defaultDeployedComment = `## Preview Environment Deployed Successfully! 🚀
+
+Your preview environment is now available at:
+**{{.URL}}**{{range .Notes}}
+
+{{.}}{{end}}`
+
+const defaultCleanupComment = `## Preview Environment Cleanup Complete 🧹
+
+The preview environment for PR #{{.PR}} has been successfully cleaned up.
+
+All resources have been removed:{{range .Resources}}
+- {{.}}{{end}}`
+
+func (pm *PreviewManager) commentData() commentData {
+	return commentData{
+		App: pm.cfg.AppName,
+		PR:  pm.cfg.PRNumber,
+		URL: "https://" + pm.fullDomain,
+		SHA: pm.cfg.SHA,
+	}
+}
+
+// renderComment executes a comment template, or fallback when it is empty.
+func renderComment(text, fallback string, data commentData) (string, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New("comment").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse comment template: %w", err)
+	}
+
+	var body strings.Builder
+	if err := tmpl.Execute(&body, data); err != nil {
+		return "", fmt.Errorf("failed to render comment template: %w", err)
+	}
+	return body.String(), nil
+}
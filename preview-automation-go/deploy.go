@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,59 +21,267 @@ import (
 	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/google/go-github/v66/github"
+	"github.com/aws/smithy-go"
 )
 
+// cloudFrontHostedZoneID is the fixed hosted zone ID used for alias records
+// that target any CloudFront distribution.
+const cloudFrontHostedZoneID = "Z2FDTNDATAQYW2"
+
+// deployStage is one resumable step of a deploy.
+type deployStage struct {
+	name string
+	run  func(ctx context.Context, journal *deployJournal) error
+}
+
 func (pm *PreviewManager) Deploy(ctx context.Context) error {
-	fmt.Println("Starting deployment...")
+	fmt.Fprintln(pm.out, "Starting deployment...")
 
-	if err := pm.createS3Bucket(ctx); err != nil {
-		return fmt.Errorf("failed to create S3 bucket: %w", err)
+	if err := pm.build(ctx); err != nil {
+		return err
 	}
 
-	if err := pm.syncFilesToS3(ctx); err != nil {
-		return fmt.Errorf("failed to sync files to S3: %w", err)
+	// Nothing is created before the source is known to be safe to publish.
+	if err := pm.scanSource(ctx); err != nil {
+		var scanErr *scanError
+		if errors.As(err, &scanErr) {
+			if commentErr := pm.postScanFailedComment(ctx, scanErr); commentErr != nil {
+				fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", commentErr)
+			}
+		}
+		return err
 	}
 
-	oacID, err := pm.getOrCreateOAC(ctx)
+	journal, err := pm.startJournal(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to manage OAC: %w", err)
+		return err
 	}
 
-	distributionID, err := pm.getOrCreateCloudFrontDistribution(ctx, oacID)
+	pm.deployRef, err = pm.newDeployRef(journal)
 	if err != nil {
-		return fmt.Errorf("failed to manage CloudFront distribution: %w", err)
+		return err
 	}
 
-	if err := pm.setBucketPolicyForOAC(ctx, distributionID); err != nil {
-		return fmt.Errorf("failed to set bucket policy: %w", err)
+	pm.auth, err = pm.loadAuth(ctx)
+	if err != nil {
+		return err
+	}
+
+	stages := []deployStage{
+		{"bucket", func(ctx context.Context, j *deployJournal) error {
+			created, err := pm.createS3Bucket(ctx)
+			// Recorded even when hardening fails so rollback removes the bucket.
+			if created {
+				j.NewPreview = true
+				j.created(resourceBucket, pm.bucketName)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to create S3 bucket: %w", err)
+			}
+			return nil
+		}},
+		{"sync", func(ctx context.Context, j *deployJournal) error {
+			result, err := pm.syncFilesToS3(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to sync files to S3: %w", err)
+			}
+			j.Sync = result
+			return nil
+		}},
+		{"expiry", func(ctx context.Context, j *deployJournal) error {
+			if err := pm.recordDeploy(ctx); err != nil {
+				return fmt.Errorf("failed to record deploy: %w", err)
+			}
+			if !pm.expiresAt.IsZero() {
+				expiresAt := pm.expiresAt
+				j.ExpiresAt = &expiresAt
+			}
+			return nil
+		}},
+		{"oac", func(ctx context.Context, j *deployJournal) error {
+			oacID, created, err := pm.getOrCreateOAC(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to manage OAC: %w", err)
+			}
+			j.OACID = oacID
+			if created {
+				j.created(resourceOAC, oacID)
+			}
+			return nil
+		}},
+		{"function", func(ctx context.Context, j *deployJournal) error {
+			functionARN, err := pm.ensureViewerRequestFunction(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to manage CloudFront Function: %w", err)
+			}
+			j.FunctionARN = functionARN
+			return nil
+		}},
+		{"headers", func(ctx context.Context, j *deployJournal) error {
+			policyID, err := pm.ensureResponseHeadersPolicy(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to manage response headers policy: %w", err)
+			}
+			j.HeadersPolicyID = policyID
+			return nil
+		}},
+		{"waf", func(ctx context.Context, j *deployJournal) error {
+			webACLARN, err := pm.ensureWebACL(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to manage WAF allowlist: %w", err)
+			}
+			j.WebACLARN = webACLARN
+			return nil
+		}},
+		{"distribution", func(ctx context.Context, j *deployJournal) error {
+			distributionID, created, err := pm.getOrCreateCloudFrontDistribution(ctx, distributionSettings{
+				OACID:           j.OACID,
+				FunctionARN:     j.FunctionARN,
+				WebACLARN:       j.WebACLARN,
+				HeadersPolicyID: j.HeadersPolicyID,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to manage CloudFront distribution: %w", err)
+			}
+			j.DistributionID = distributionID
+			if created {
+				j.created(resourceDistribution, distributionID)
+			}
+			return pm.tagDistributionRepo(ctx, distributionID)
+		}},
+		{"bucket-policy", func(ctx context.Context, j *deployJournal) error {
+			if err := pm.setBucketPolicyForOAC(ctx, j.DistributionID); err != nil {
+				return fmt.Errorf("failed to set bucket policy: %w", err)
+			}
+			return nil
+		}},
+		{"invalidation", func(ctx context.Context, j *deployJournal) error {
+			// A new distribution has nothing cached yet.
+			if _, created := j.Created[resourceDistribution]; created {
+				j.InvalidationNote = "skipped, new distribution"
+				fmt.Fprintln(pm.out, "Skipping cache invalidation (new distribution)")
+				return nil
+			}
+
+			var changed []string
+			if j.Sync != nil {
+				changed = j.Sync.changedKeys()
+			}
+			// Files a failed deploy uploaded are unchanged for this one but
+			// may still be cached.
+			changed = append(changed, j.PendingInvalidation...)
+			paths := invalidationPaths(changed, pm.cfg.InvalidationMaxPaths)
+			if j.InvalidateAll {
+				paths = []string{"/*"}
+			}
+			if len(paths) == 0 {
+				j.InvalidationNote = "skipped, no files changed"
+				fmt.Fprintln(pm.out, "Skipping cache invalidation (no files changed)")
+				return nil
+			}
+
+			invalidationID, err := pm.invalidateCloudFrontCache(ctx, j.DistributionID, paths)
+			if err != nil {
+				return fmt.Errorf("failed to invalidate CloudFront cache: %w", err)
+			}
+			j.InvalidationID = invalidationID
+			j.InvalidationPaths = paths
+			return nil
+		}},
+		{"dns", func(ctx context.Context, j *deployJournal) error {
+			changeID, created, err := pm.updateRoute53(ctx, j.DistributionID)
+			if err != nil {
+				return fmt.Errorf("failed to update Route53: %w", err)
+			}
+			j.ChangeID = changeID
+			if created {
+				j.created(resourceDNS, pm.fullDomain)
+			}
+			return nil
+		}},
+		{"registry", func(ctx context.Context, j *deployJournal) error {
+			err := pm.updateRecord(ctx, func(r *previewRecord) {
+				now := time.Now().UTC()
+				r.Status = recordActive
+				r.SHA = pm.cfg.SHA
+				r.DistributionID = j.DistributionID
+				r.OACID = j.OACID
+				r.HostedZoneID = pm.hostedZoneID
+				r.LastDeployedAt = &now
+				r.DeletedAt = nil
+				r.ExpiresAt, r.TTL, r.ExpiryWarned = nil, "", false
+				if !pm.expiresAt.IsZero() {
+					expiresAt := pm.expiresAt
+					r.ExpiresAt = &expiresAt
+					r.TTL = formatDuration(pm.cfg.TTL)
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("failed to update preview registry: %w", err)
+			}
+			return nil
+		}},
+	}
+
+	if pm.cfg.Wait {
+		stages = append(stages, deployStage{"wait", func(ctx context.Context, j *deployJournal) error {
+			if err := pm.waitForPreview(ctx, j.DistributionID, j.InvalidationID, j.ChangeID); err != nil {
+				return fmt.Errorf("preview did not go live: %w", err)
+			}
+			return nil
+		}})
 	}
 
-	if err := pm.invalidateCloudFrontCache(ctx, distributionID); err != nil {
-		return fmt.Errorf("failed to invalidate CloudFront cache: %w", err)
+	if pm.cfg.Verify {
+		stages = append(stages, deployStage{"verify", func(ctx context.Context, j *deployJournal) error {
+			if err := pm.verifyPreview(ctx); err != nil {
+				if commentErr := pm.postVerificationFailedComment(ctx, err); commentErr != nil {
+					fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", commentErr)
+				}
+				return fmt.Errorf("preview verification failed: %w", err)
+			}
+			return nil
+		}})
 	}
 
-	if err := pm.updateRoute53(ctx, distributionID); err != nil {
-		return fmt.Errorf("failed to update Route53: %w", err)
+	for _, stage := range stages {
+		if done, ok := journal.done(stage.name); ok {
+			fmt.Fprintf(pm.out, "Skipping %s (completed by run %s)\n", stage.name, done.RunID)
+			continue
+		}
+		if err := stage.run(ctx, journal); err != nil {
+			return pm.failDeploy(ctx, journal, stage.name, err)
+		}
+		journal.complete(stage.name)
+		pm.saveJournal(ctx, journal)
+	}
+
+	journal.Completed = true
+	pm.saveJournal(ctx, journal)
+
+	if err := pm.printDeploySummary(journal); err != nil {
+		return err
 	}
 
 	if err := pm.postGitHubComment(ctx); err != nil {
-		fmt.Printf("Warning: Failed to post GitHub comment: %v\n", err)
+		fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
 	}
 
 	return nil
 }
 
-func (pm *PreviewManager) createS3Bucket(ctx context.Context) error {
-	fmt.Printf("Creating S3 bucket: %s\n", pm.bucketName)
+// createS3Bucket creates the preview bucket and reports whether it did not
+// exist yet.
+func (pm *PreviewManager) createS3Bucket(ctx context.Context) (bool, error) {
+	fmt.Fprintf(pm.out, "Creating S3 bucket: %s\n", pm.bucketName)
 
 	_, err := pm.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(pm.bucketName),
 	})
 
 	if err == nil {
-		fmt.Println("  ✓ Bucket already exists")
-		return nil
+		fmt.Fprintln(pm.out, "  ✓ Bucket already exists")
+		return false, pm.hardenBucket(ctx)
 	}
 
 	createInput := &s3.CreateBucketInput{
@@ -82,18 +296,50 @@ func (pm *PreviewManager) createS3Bucket(ctx context.Context) error {
 
 	_, err = pm.s3Client.CreateBucket(ctx, createInput)
 	if err != nil {
-		return fmt.Errorf("failed to create bucket: %w", err)
+		return false, fmt.Errorf("failed to create bucket: %w", err)
 	}
 
-	fmt.Println("  ✓ Bucket created")
-	return nil
+	fmt.Fprintln(pm.out, "  ✓ Bucket created")
+	return true, pm.hardenBucket(ctx)
 }
 
-func (pm *PreviewManager) syncFilesToS3(ctx context.Context) error {
-	fmt.Printf("Syncing files from %s to S3...\n", pm.cfg.SourcePath)
+// syncFilesToS3 uploads the files whose content differs from the bucket,
+// compared by MD5 against the object ETag, and deletes objects that are no
+// longer in the source directory.
+func (pm *PreviewManager) syncFilesToS3(ctx context.Context) (*syncResult, error) {
+	fmt.Fprintf(pm.out, "Syncing files from %s to S3...\n", pm.cfg.SourcePath)
 
-	fileCount := 0
-	err := filepath.Walk(pm.cfg.SourcePath, func(path string, info os.FileInfo, err error) error {
+	existing, err := pm.listObjectETags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := pm.compareSource(ctx, existing, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ Uploaded %d files, updated headers of %d, deleted %d stale files, %d unchanged\n", len(result.Uploaded), len(result.Updated), len(result.Deleted), result.Unchanged)
+	return result, nil
+}
+
+// compareSource compares the source directory with the objects in existing,
+// a map of key to ETag. With apply, changed files are uploaded, unchanged
+// objects whose Content-Type or Cache-Control is out of date are updated in
+// place and stale objects deleted; otherwise the result only says what a sync
+// would do.
+func (pm *PreviewManager) compareSource(ctx context.Context, existing map[string]string, apply bool) (*syncResult, error) {
+	rules, err := parseCacheRules(pm.cfg.CacheRules)
+	if err != nil {
+		return nil, err
+	}
+
+	type sourceFile struct {
+		key, path, contentType string
+	}
+	var files []sourceFile
+	local := make(map[string]bool)
+	err = filepath.Walk(pm.cfg.SourcePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -108,55 +354,141 @@ func (pm *PreviewManager) syncFilesToS3(ctx context.Context) error {
 		}
 
 		s3Key := filepath.ToSlash(relPath)
+		local[s3Key] = true
+		files = append(files, sourceFile{s3Key, path, getContentType(path)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		contentType := getContentType(path)
+	// Previews must not be indexed, so builds without a robots.txt get one.
+	injectRobots := pm.cfg.Noindex && !local[robotsTxtKey]
+	if injectRobots {
+		local[robotsTxtKey] = true
+		files = append(files, sourceFile{robotsTxtKey, "", "text/plain"})
+	}
 
-		data, err := os.ReadFile(path)
+	// Unchanged objects only need their headers checked when the headers of
+	// the source differ from those of the last sync, e.g. after a cache rule
+	// changed.
+	fingerprint := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(fingerprint, "%s\t%s\t%s\n", file.key, file.contentType, cacheControl(rules, file.key))
+	}
+	headersFingerprint := hex.EncodeToString(fingerprint.Sum(nil))
+	checkHeaders := false
+	if len(existing) > 0 {
+		tags, err := pm.getBucketTags(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to read file %s: %w", path, err)
+			return nil, err
 		}
+		checkHeaders = tags[headersTag] != headersFingerprint
+	}
 
-		_, err = pm.s3Client.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:      aws.String(pm.bucketName),
-			Key:         aws.String(s3Key),
-			Body:        strings.NewReader(string(data)),
-			ContentType: aws.String(contentType),
-		})
+	result := &syncResult{}
+	unchanged := func(s3Key, contentType string) error {
+		if !checkHeaders {
+			result.Unchanged++
+			return nil
+		}
+		updated, err := pm.updateObjectHeaders(ctx, s3Key, contentType, cacheControl(rules, s3Key), apply)
 		if err != nil {
-			return fmt.Errorf("failed to upload %s: %w", s3Key, err)
+			return err
+		}
+		if updated {
+			result.Updated = append(result.Updated, s3Key)
+		} else {
+			result.Unchanged++
+		}
+		return nil
+	}
+	upload := func(s3Key, contentType string, data []byte) error {
+		sum := md5.Sum(data)
+		hash := hex.EncodeToString(sum[:])
+		if existing[s3Key] == hash {
+			return unchanged(s3Key, contentType)
+		}
+		if _, ok := existing[s3Key]; ok && pm.cfg.KMSKeyID != "" {
+			recorded, err := pm.objectMD5(ctx, s3Key)
+			if err != nil {
+				return err
+			}
+			if recorded == hash {
+				return unchanged(s3Key, contentType)
+			}
 		}
 
-		fileCount++
+		if apply {
+			_, err := pm.s3Client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:       aws.String(pm.bucketName),
+				Key:          aws.String(s3Key),
+				Body:         strings.NewReader(string(data)),
+				ContentType:  aws.String(contentType),
+				CacheControl: optionalString(cacheControl(rules, s3Key)),
+				Metadata:     map[string]string{md5MetadataKey: hash},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to upload %s: %w", s3Key, err)
+			}
+		}
+
+		result.Uploaded = append(result.Uploaded, s3Key)
 		return nil
-	})
-	if err != nil {
-		return err
 	}
 
-	fmt.Printf("  ✓ Uploaded %d files\n", fileCount)
-	return nil
+	for _, file := range files {
+		data := []byte(noindexRobotsTxt)
+		if file.path != "" {
+			if data, err = os.ReadFile(file.path); err != nil {
+				return nil, fmt.Errorf("failed to read file %s: %w", file.path, err)
+			}
+		}
+		if err := upload(file.key, file.contentType, data); err != nil {
+			return nil, err
+		}
+	}
+	if injectRobots && apply {
+		fmt.Fprintln(pm.out, "  ✓ Injected robots.txt disallowing all crawlers")
+	}
+
+	for key := range existing {
+		if !local[key] {
+			result.Deleted = append(result.Deleted, key)
+		}
+	}
+	sort.Strings(result.Deleted)
+	if apply {
+		if err := pm.deleteObjects(ctx, result.Deleted); err != nil {
+			return nil, err
+		}
+		if err := pm.updateBucketTags(ctx, map[string]string{headersTag: headersFingerprint}); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
 }
 
-func (pm *PreviewManager) getOrCreateOAC(ctx context.Context) (string, error) {
-	fmt.Println("Managing Origin Access Control...")
+// getOrCreateOAC returns the ID of the preview OAC and whether it was created.
+func (pm *PreviewManager) getOrCreateOAC(ctx context.Context) (string, bool, error) {
+	fmt.Fprintln(pm.out, "Managing Origin Access Control...")
 
-	oacName := fmt.Sprintf("OAC-%s", pm.bucketName)
+	oacName := pm.oacName()
 
-	listResult, err := pm.cfClient.ListOriginAccessControls(ctx, &cloudfront.ListOriginAccessControlsInput{})
+	oacs, err := pm.listOriginAccessControls(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to list OACs: %w", err)
+		return "", false, err
 	}
 
-	if listResult.OriginAccessControlList != nil && listResult.OriginAccessControlList.Items != nil {
-		for _, oac := range listResult.OriginAccessControlList.Items {
-			if *oac.Name == oacName {
-				fmt.Printf("  ✓ Using existing OAC: %s\n", *oac.Id)
-				return *oac.Id, nil
-			}
+	for _, oac := range oacs {
+		if *oac.Name == oacName {
+			fmt.Fprintf(pm.out, "  ✓ Using existing OAC: %s\n", *oac.Id)
+			return *oac.Id, false, nil
 		}
 	}
 
-	fmt.Println("  Creating new Origin Access Control...")
+	fmt.Fprintln(pm.out, "  Creating new Origin Access Control...")
 	createResult, err := pm.cfClient.CreateOriginAccessControl(ctx, &cloudfront.CreateOriginAccessControlInput{
 		OriginAccessControlConfig: &cftypes.OriginAccessControlConfig{
 			Name:                          aws.String(oacName),
@@ -167,16 +499,20 @@ func (pm *PreviewManager) getOrCreateOAC(ctx context.Context) (string, error) {
 		},
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create OAC: %w", err)
+		return "", false, fmt.Errorf("failed to create OAC: %w", err)
 	}
 
 	oacID := *createResult.OriginAccessControl.Id
-	fmt.Printf("  ✓ OAC created: %s\n", oacID)
-	return oacID, nil
+	fmt.Fprintf(pm.out, "  ✓ OAC created: %s\n", oacID)
+	return oacID, true, nil
 }
 
+// setBucketPolicyForOAC merges the statements letting the distribution read
+// the bucket and requiring TLS into the bucket policy. Statements added by
+// others are kept, as are grants to other distributions that still exist,
+// e.g. while a preview moves to a new distribution.
 func (pm *PreviewManager) setBucketPolicyForOAC(ctx context.Context, distributionID string) error {
-	fmt.Println("Setting bucket policy for CloudFront OAC access...")
+	fmt.Fprintln(pm.out, "Setting bucket policy for CloudFront OAC access...")
 
 	dist, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
 		Id: aws.String(distributionID),
@@ -187,65 +523,140 @@ func (pm *PreviewManager) setBucketPolicyForOAC(ctx context.Context, distributio
 
 	distributionARN := *dist.Distribution.ARN
 
-	policy := fmt.Sprintf(`{
-		"Version": "2012-10-17",
-		"Statement": [
-			{
-				"Sid": "AllowCloudFrontServicePrincipal",
-				"Effect": "Allow",
-				"Principal": {
-					"Service": "cloudfront.amazonaws.com"
-				},
-				"Action": "s3:GetObject",
-				"Resource": "arn:aws:s3:::%s/*",
-				"Condition": {
-					"StringEquals": {
-						"AWS:SourceArn": "%s"
-					}
-				}
-			}
-		]
-	}`, pm.bucketName, distributionARN)
+	policy, err := pm.getBucketPolicy(ctx, pm.bucketName)
+	if err != nil {
+		return err
+	}
+
+	granted := slices.DeleteFunc(slices.Clone(grantedDistributionARNs(policy)), func(arn string) bool {
+		return arn == distributionARN
+	})
+	others, err := pm.liveDistributionARNs(ctx, granted)
+	if err != nil {
+		return err
+	}
+	slices.Sort(others)
+	distributionARNs := append([]string{distributionARN}, slices.Compact(others)...)
+
+	diff := policy.merge(pm.bucketPolicyStatements(distributionARNs))
+	if len(diff) == 0 {
+		fmt.Fprintln(pm.out, "  ✓ Bucket policy already up to date")
+		return pm.allowCloudFrontDecrypt(ctx, distributionARN)
+	}
+	pm.printPolicyDiff(diff)
 
 	_, err = pm.s3Client.PutBucketPolicy(ctx, &s3.PutBucketPolicyInput{
 		Bucket: aws.String(pm.bucketName),
-		Policy: aws.String(policy),
+		Policy: aws.String(policy.String()),
 	})
 	if err != nil {
 		return fmt.Errorf("failed to set bucket policy: %w", err)
 	}
 
-	fmt.Println("  ✓ Bucket policy configured for CloudFront access")
-	return nil
+	fmt.Fprintf(pm.out, "  ✓ Bucket policy configured for CloudFront access (%d distribution(s))\n", len(distributionARNs))
+	return pm.allowCloudFrontDecrypt(ctx, distributionARN)
+}
+
+// distributionSettings are the resources a deploy attaches to the
+// distribution.
+type distributionSettings struct {
+	OACID       string
+	FunctionARN string
+	WebACLARN   string
+	// HeadersPolicyID is "" when no response headers are configured.
+	HeadersPolicyID string
 }
 
-func (pm *PreviewManager) getOrCreateCloudFrontDistribution(ctx context.Context, oacID string) (string, error) {
-	fmt.Println("Managing CloudFront distribution...")
+// getOrCreateCloudFrontDistribution returns the ID of the preview
+// distribution and whether it was created.
+func (pm *PreviewManager) getOrCreateCloudFrontDistribution(ctx context.Context, settings distributionSettings) (string, bool, error) {
+	fmt.Fprintln(pm.out, "Managing CloudFront distribution...")
 
 	distributionID, err := pm.findCloudFrontDistribution(ctx)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	if distributionID != "" {
-		fmt.Printf("  ✓ Using existing distribution: %s\n", distributionID)
-		return distributionID, nil
+		fmt.Fprintf(pm.out, "  ✓ Using existing distribution: %s\n", distributionID)
+		if err := pm.reconcileDistribution(ctx, distributionID, settings); err != nil {
+			return "", false, err
+		}
+		return distributionID, false, nil
 	}
 
-	return pm.createCloudFrontDistribution(ctx, oacID)
+	distributionID, err = pm.createCloudFrontDistribution(ctx, settings)
+	if err != nil {
+		return "", false, err
+	}
+	return distributionID, true, nil
 }
 
-func (pm *PreviewManager) findCloudFrontDistribution(ctx context.Context) (string, error) {
-	result, err := pm.cfClient.ListDistributions(ctx, &cloudfront.ListDistributionsInput{})
+// reconcileDistribution brings an existing distribution in line with what a
+// freshly created one would look like. A distribution that cleanup disabled
+// for asynchronous deletion is taken back, e.g. when the PR is reopened.
+func (pm *PreviewManager) reconcileDistribution(ctx context.Context, distributionID string, settings distributionSettings) error {
+	dist, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+		Id: aws.String(distributionID),
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to list distributions: %w", err)
+		return fmt.Errorf("failed to get distribution: %w", err)
 	}
 
-	if result.DistributionList == nil || result.DistributionList.Items == nil {
-		return "", nil
+	tags, err := pm.getDistributionTags(ctx, *dist.Distribution.ARN)
+	if err != nil {
+		return err
 	}
 
-	for _, dist := range result.DistributionList.Items {
+	if _, pending := tags[pendingDeletionTag]; pending {
+		fmt.Fprintln(pm.out, "  Reclaiming distribution pending deletion...")
+		if err := pm.clearPendingDeletion(ctx, *dist.Distribution.ARN); err != nil {
+			return err
+		}
+	}
+
+	changed, err := pm.updateDistributionConfig(ctx, distributionID, func(cfg *cftypes.DistributionConfig) bool {
+		changed := false
+		if !aws.ToBool(cfg.Enabled) {
+			cfg.Enabled = aws.Bool(true)
+			changed = true
+		}
+		// Distributions created before the AAAA alias record was introduced
+		// have IPv6 turned off.
+		if !aws.ToBool(cfg.IsIPV6Enabled) {
+			cfg.IsIPV6Enabled = aws.Bool(true)
+			changed = true
+		}
+		if applyRouting(cfg, pm.cfg.Routing, settings.FunctionARN) {
+			changed = true
+		}
+		if aws.ToString(cfg.WebACLId) != settings.WebACLARN {
+			cfg.WebACLId = aws.String(settings.WebACLARN)
+			changed = true
+		}
+		if aws.ToString(cfg.DefaultCacheBehavior.ResponseHeadersPolicyId) != settings.HeadersPolicyID {
+			cfg.DefaultCacheBehavior.ResponseHeadersPolicyId = optionalString(settings.HeadersPolicyID)
+			changed = true
+		}
+		return changed
+	})
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		fmt.Fprintln(pm.out, "  ✓ Distribution configuration updated")
+	}
+	return nil
+}
+
+func (pm *PreviewManager) findCloudFrontDistribution(ctx context.Context) (string, error) {
+	distributions, err := pm.listDistributions(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dist := range distributions {
 		if dist.Aliases != nil && dist.Aliases.Items != nil {
 			for _, alias := range dist.Aliases.Items {
 				if alias == pm.fullDomain {
@@ -258,22 +669,25 @@ func (pm *PreviewManager) findCloudFrontDistribution(ctx context.Context) (strin
 	return "", nil
 }
 
-func (pm *PreviewManager) createCloudFrontDistribution(ctx context.Context, oacID string) (string, error) {
-	fmt.Println("  Creating new CloudFront distribution...")
+func (pm *PreviewManager) createCloudFrontDistribution(ctx context.Context, settings distributionSettings) (string, error) {
+	fmt.Fprintln(pm.out, "  Creating new CloudFront distribution...")
 
 	s3DomainName := fmt.Sprintf("%s.s3.%s.amazonaws.com", pm.bucketName, pm.cfg.Region)
-	callerReference := fmt.Sprintf("pr-%d-%d", pm.cfg.PRNumber, time.Now().Unix())
+	callerReference := "distribution-" + pm.deployRef
+	comment := fmt.Sprintf("PR #%d Preview Environment", pm.cfg.PRNumber)
 
 	input := &cloudfront.CreateDistributionInput{
 		DistributionConfig: &cftypes.DistributionConfig{
 			CallerReference: aws.String(callerReference),
-			Comment:         aws.String(fmt.Sprintf("PR #%d Preview Environment", pm.cfg.PRNumber)),
+			Comment:         aws.String(comment),
 			Enabled:         aws.Bool(true),
+			IsIPV6Enabled:   aws.Bool(true),
 			Aliases: &cftypes.Aliases{
 				Quantity: aws.Int32(1),
 				Items:    []string{pm.fullDomain},
 			},
 			DefaultRootObject: aws.String("index.html"),
+			WebACLId:          aws.String(settings.WebACLARN),
 			Origins: &cftypes.Origins{
 				Quantity: aws.Int32(1),
 				Items: []cftypes.Origin{
@@ -283,13 +697,14 @@ func (pm *PreviewManager) createCloudFrontDistribution(ctx context.Context, oacI
 						S3OriginConfig: &cftypes.S3OriginConfig{
 							OriginAccessIdentity: aws.String(""),
 						},
-						OriginAccessControlId: aws.String(oacID),
+						OriginAccessControlId: aws.String(settings.OACID),
 					},
 				},
 			},
 			DefaultCacheBehavior: &cftypes.DefaultCacheBehavior{
-				TargetOriginId:       aws.String(fmt.Sprintf("S3-%s", pm.bucketName)),
-				ViewerProtocolPolicy: cftypes.ViewerProtocolPolicyRedirectToHttps,
+				TargetOriginId:          aws.String(fmt.Sprintf("S3-%s", pm.bucketName)),
+				ViewerProtocolPolicy:    cftypes.ViewerProtocolPolicyRedirectToHttps,
+				ResponseHeadersPolicyId: optionalString(settings.HeadersPolicyID),
 				AllowedMethods: &cftypes.AllowedMethods{
 					Quantity: aws.Int32(2),
 					Items:    []cftypes.Method{cftypes.MethodGet, cftypes.MethodHead},
@@ -313,19 +728,9 @@ func (pm *PreviewManager) createCloudFrontDistribution(ctx context.Context, oacI
 					Quantity: aws.Int32(0),
 				},
 			},
-			CustomErrorResponses: &cftypes.CustomErrorResponses{
-				Quantity: aws.Int32(1),
-				Items: []cftypes.CustomErrorResponse{
-					{
-						ErrorCode:          aws.Int32(404),
-						ResponsePagePath:   aws.String("/index.html"),
-						ResponseCode:       aws.String("200"),
-						ErrorCachingMinTTL: aws.Int64(300),
-					},
-				},
-			},
 		},
 	}
+	applyRouting(input.DistributionConfig, pm.cfg.Routing, settings.FunctionARN)
 
 	if pm.cfg.CertificateARN != "" {
 		input.DistributionConfig.ViewerCertificate = &cftypes.ViewerCertificate{
@@ -340,124 +745,230 @@ func (pm *PreviewManager) createCloudFrontDistribution(ctx context.Context, oacI
 	}
 
 	result, err := pm.cfClient.CreateDistribution(ctx, input)
+	var alreadyExists *cftypes.DistributionAlreadyExists
+	if errors.As(err, &alreadyExists) {
+		// An earlier attempt of this deploy created it, e.g. before a
+		// timeout hid the response.
+		distributionID, findErr := pm.findDistributionByCallerReference(ctx, callerReference, comment)
+		if findErr != nil {
+			return "", findErr
+		}
+		if distributionID == "" {
+			return "", fmt.Errorf("failed to create distribution: %w", err)
+		}
+		fmt.Fprintf(pm.out, "  ✓ Adopted distribution created by an earlier attempt: %s\n", distributionID)
+		return distributionID, nil
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to create distribution: %w", err)
 	}
 
 	distributionID := *result.Distribution.Id
-	fmt.Printf("  ✓ Distribution created: %s\n", distributionID)
+	fmt.Fprintf(pm.out, "  ✓ Distribution created: %s\n", distributionID)
 
 	return distributionID, nil
 }
 
-func (pm *PreviewManager) invalidateCloudFrontCache(ctx context.Context, distributionID string) error {
-	fmt.Println("Invalidating CloudFront cache...")
+func (pm *PreviewManager) invalidateCloudFrontCache(ctx context.Context, distributionID string, paths []string) (string, error) {
+	fmt.Fprintf(pm.out, "Invalidating CloudFront cache (%d path(s))...\n", len(paths))
 
-	_, err := pm.cfClient.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
+	callerReference := pm.invalidationRef(paths)
+	result, err := pm.cfClient.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
 		DistributionId: aws.String(distributionID),
 		InvalidationBatch: &cftypes.InvalidationBatch{
-			CallerReference: aws.String(fmt.Sprintf("invalidation-%d", time.Now().Unix())),
+			CallerReference: aws.String(callerReference),
 			Paths: &cftypes.Paths{
-				Quantity: aws.Int32(1),
-				Items:    []string{"/*"},
+				Quantity: aws.Int32(int32(len(paths))),
+				Items:    paths,
 			},
 		},
 	})
+	// The SDK has no modeled type for this error.
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidationBatchAlreadyExists" {
+		invalidationID, findErr := pm.findInvalidationByCallerReference(ctx, distributionID, callerReference)
+		if findErr != nil {
+			return "", findErr
+		}
+		if invalidationID == "" {
+			return "", fmt.Errorf("failed to create invalidation: %w", err)
+		}
+		fmt.Fprintf(pm.out, "  ✓ Adopted invalidation created by an earlier attempt: %s\n", invalidationID)
+		return invalidationID, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create invalidation: %w", err)
+		return "", fmt.Errorf("failed to create invalidation: %w", err)
 	}
 
-	fmt.Println("  ✓ Cache invalidation created")
-	return nil
+	invalidationID := *result.Invalidation.Id
+	fmt.Fprintf(pm.out, "  ✓ Cache invalidation created: %s\n", invalidationID)
+	return invalidationID, nil
 }
 
-func (pm *PreviewManager) updateRoute53(ctx context.Context, distributionID string) error {
-	fmt.Println("Updating Route53 DNS records...")
+// updateRoute53 points the preview domain at the distribution and returns the
+// Route53 change ID and whether the alias records are new.
+func (pm *PreviewManager) updateRoute53(ctx context.Context, distributionID string) (string, bool, error) {
+	fmt.Fprintln(pm.out, "Updating Route53 DNS records...")
 
 	hostedZoneID, err := pm.getHostedZoneID(ctx)
 	if err != nil {
-		return err
+		return "", false, err
 	}
 
 	dist, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
 		Id: aws.String(distributionID),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to get distribution: %w", err)
+		return "", false, fmt.Errorf("failed to get distribution: %w", err)
 	}
 
 	cfDomain := *dist.Distribution.DomainName
 
-	_, err = pm.r53Client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
-		HostedZoneId: aws.String(hostedZoneID),
-		ChangeBatch: &r53types.ChangeBatch{
-			Changes: []r53types.Change{
-				{
-					Action: r53types.ChangeActionUpsert,
-					ResourceRecordSet: &r53types.ResourceRecordSet{
-						Name: aws.String(pm.fullDomain),
-						Type: r53types.RRTypeCname,
-						TTL:  aws.Int64(300),
-						ResourceRecords: []r53types.ResourceRecord{
-							{
-								Value: aws.String(cfDomain),
-							},
-						},
-					},
+	existing, err := pm.listPreviewRecordSets(ctx, hostedZoneID)
+	if err != nil {
+		return "", false, err
+	}
+
+	created := true
+	var changes []r53types.Change
+
+	// Previews created before alias records were introduced have a CNAME,
+	// which cannot coexist with A/AAAA records of the same name.
+	for _, recordSet := range existing {
+		if recordSet.Type == r53types.RRTypeA {
+			created = false
+		}
+		if recordSet.Type == r53types.RRTypeCname {
+			fmt.Fprintln(pm.out, "  Replacing legacy CNAME record")
+			changes = append(changes, r53types.Change{
+				Action:            r53types.ChangeActionDelete,
+				ResourceRecordSet: &recordSet,
+			})
+		}
+	}
+
+	for _, recordType := range []r53types.RRType{r53types.RRTypeA, r53types.RRTypeAaaa} {
+		changes = append(changes, r53types.Change{
+			Action: r53types.ChangeActionUpsert,
+			ResourceRecordSet: &r53types.ResourceRecordSet{
+				Name: aws.String(pm.fullDomain),
+				Type: recordType,
+				AliasTarget: &r53types.AliasTarget{
+					HostedZoneId:         aws.String(cloudFrontHostedZoneID),
+					DNSName:              aws.String(cfDomain),
+					EvaluateTargetHealth: false,
 				},
 			},
+		})
+	}
+
+	result, err := pm.r53Client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+		ChangeBatch: &r53types.ChangeBatch{
+			Changes: changes,
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update DNS record: %w", err)
+		return "", false, fmt.Errorf("failed to update DNS records: %w", err)
 	}
 
-	fmt.Println("  ✓ DNS record updated")
-	return nil
+	fmt.Fprintln(pm.out, "  ✓ DNS alias records (A/AAAA) updated")
+	return *result.ChangeInfo.Id, created, nil
 }
 
-func (pm *PreviewManager) getHostedZoneID(ctx context.Context) (string, error) {
-	result, err := pm.r53Client.ListHostedZonesByName(ctx, &route53.ListHostedZonesByNameInput{
-		DNSName: aws.String(pm.cfg.BaseDomain),
+// listPreviewRecordSets returns the A, AAAA and CNAME record sets named after
+// the preview domain.
+func (pm *PreviewManager) listPreviewRecordSets(ctx context.Context, hostedZoneID string) ([]r53types.ResourceRecordSet, error) {
+	result, err := pm.r53Client.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(hostedZoneID),
+		StartRecordName: aws.String(pm.fullDomain),
+		MaxItems:        aws.Int32(10),
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to list hosted zones: %w", err)
+		return nil, fmt.Errorf("failed to list records: %w", err)
 	}
 
-	if len(result.HostedZones) == 0 {
-		return "", fmt.Errorf("no hosted zone found for domain: %s", pm.cfg.BaseDomain)
+	var recordSets []r53types.ResourceRecordSet
+	for _, recordSet := range result.ResourceRecordSets {
+		if !strings.EqualFold(*recordSet.Name, pm.fullDomain+".") {
+			continue
+		}
+		switch recordSet.Type {
+		case r53types.RRTypeA, r53types.RRTypeAaaa, r53types.RRTypeCname:
+			recordSets = append(recordSets, recordSet)
+		}
 	}
 
-	zoneID := *result.HostedZones[0].Id
-	parts := strings.Split(zoneID, "/")
-	return parts[len(parts)-1], nil
+	return recordSets, nil
 }
 
 func (pm *PreviewManager) postGitHubComment(ctx context.Context) error {
+	if pm.summarized {
+		return nil
+	}
 	if pm.githubClient == nil {
-		fmt.Println("Skipping GitHub comment (no GitHub token provided)")
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
 		return nil
 	}
 
-	fmt.Println("Posting GitHub PR comment...")
+	fmt.Fprintln(pm.out, "Posting GitHub PR comment...")
+
+	data := pm.commentData()
+	data.Notes = pm.deployNotes()
+
+	commentBody, err := renderComment(pm.cfg.DeployedComment, defaultDeployedComment, data)
+	if err != nil {
+		return err
+	}
+
+	return pm.upsertGitHubComment(ctx, commentBody)
+}
 
-	previewURL := fmt.Sprintf("https://%s", pm.fullDomain)
-	commentBody := fmt.Sprintf(`## Preview Environment Deployed Successfully! 🚀
+// deployNotes are the paragraphs of the deployed comment after the URL.
+func (pm *PreviewManager) deployNotes() []string {
+	var notes []string
 
-Your preview environment is now available at:
-**%s**
+	if pm.cfg.Verify {
+		notes = append(notes, fmt.Sprintf("✅ Smoke tests passed (%d path(s) checked).", len(pm.cfg.VerifyPaths)+1))
+	}
 
-Note: Initial deployment may take 3-5 minutes for CloudFront to propagate globally.`, previewURL)
+	if note := pm.authNote(); note != "" {
+		notes = append(notes, note)
+	}
 
-	comment := &github.IssueComment{
-		Body: github.String(commentBody),
+	if !pm.expiresAt.IsZero() {
+		notes = append(notes, fmt.Sprintf("This preview expires on %s unless new commits are pushed. Comment `/preview extend` to keep it longer.", pm.expiresAt.Format(time.RFC1123)))
 	}
 
-	_, _, err := pm.githubClient.Issues.CreateComment(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber, comment)
-	if err != nil {
-		return fmt.Errorf("failed to create comment: %w", err)
+	if !pm.cfg.Wait {
+		notes = append(notes, "Note: Initial deployment may take 3-5 minutes for CloudFront to propagate globally.")
 	}
 
-	fmt.Println("  ✓ GitHub PR comment posted")
-	return nil
+	return notes
+}
+
+func (pm *PreviewManager) postVerificationFailedComment(ctx context.Context, verifyErr error) error {
+	if pm.summarized {
+		return nil
+	}
+	if pm.githubClient == nil {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
+		return nil
+	}
+
+	fmt.Fprintln(pm.out, "Posting GitHub PR comment...")
+
+	failures := []string{verifyErr.Error()}
+	var ve *verifyError
+	if errors.As(verifyErr, &ve) {
+		failures = ve.Failures
+	}
+
+	commentBody := fmt.Sprintf(`## Preview Environment Verification Failed ❌
+
+The preview was deployed to **https://%s** but did not pass smoke tests:
+
+- %s`, pm.fullDomain, strings.Join(failures, "\n- "))
+
+	return pm.upsertGitHubComment(ctx, commentBody)
 }
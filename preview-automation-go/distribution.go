@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+// pendingDeletionTag marks a distribution that cleanup has disabled and that
+// the next gc run should delete once it has finished deploying.
+const pendingDeletionTag = "preview:pending-deletion"
+
+// listDistributions returns every distribution in the account.
+func (pm *PreviewManager) listDistributions(ctx context.Context) ([]cftypes.DistributionSummary, error) {
+	var distributions []cftypes.DistributionSummary
+
+	paginator := cloudfront.NewListDistributionsPaginator(pm.cfClient, &cloudfront.ListDistributionsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list distributions: %w", err)
+		}
+		if page.DistributionList != nil {
+			distributions = append(distributions, page.DistributionList.Items...)
+		}
+	}
+
+	return distributions, nil
+}
+
+// listOriginAccessControls returns every origin access control in the
+// account.
+func (pm *PreviewManager) listOriginAccessControls(ctx context.Context) ([]cftypes.OriginAccessControlSummary, error) {
+	var oacs []cftypes.OriginAccessControlSummary
+
+	input := &cloudfront.ListOriginAccessControlsInput{}
+	for {
+		result, err := pm.cfClient.ListOriginAccessControls(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list OACs: %w", err)
+		}
+
+		list := result.OriginAccessControlList
+		if list == nil {
+			return oacs, nil
+		}
+		oacs = append(oacs, list.Items...)
+
+		if !aws.ToBool(list.IsTruncated) {
+			return oacs, nil
+		}
+		input.Marker = list.NextMarker
+	}
+}
+
+func (pm *PreviewManager) oacName() string {
+	return fmt.Sprintf("OAC-%s", pm.bucketName)
+}
+
+// updateDistributionConfig fetches the distribution config, applies mutate
+// and writes it back if mutate reports a change. If another writer updates
+// the distribution in between, the whole read-modify-write is retried.
+func (pm *PreviewManager) updateDistributionConfig(ctx context.Context, distributionID string, mutate func(*cftypes.DistributionConfig) bool) (bool, error) {
+	changed := false
+	err := pm.retryOnConflict(ctx, "Distribution", func() error {
+		distConfig, err := pm.cfClient.GetDistributionConfig(ctx, &cloudfront.GetDistributionConfigInput{
+			Id: aws.String(distributionID),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get distribution config: %w", err)
+		}
+
+		changed = mutate(distConfig.DistributionConfig)
+		if !changed {
+			return nil
+		}
+
+		_, err = pm.cfClient.UpdateDistribution(ctx, &cloudfront.UpdateDistributionInput{
+			Id:                 aws.String(distributionID),
+			DistributionConfig: distConfig.DistributionConfig,
+			IfMatch:            distConfig.ETag,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update distribution: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return changed, nil
+}
+
+func (pm *PreviewManager) setDistributionEnabled(ctx context.Context, distributionID string, enabled bool) (bool, error) {
+	return pm.updateDistributionConfig(ctx, distributionID, func(cfg *cftypes.DistributionConfig) bool {
+		if aws.ToBool(cfg.Enabled) == enabled {
+			return false
+		}
+		cfg.Enabled = aws.Bool(enabled)
+		return true
+	})
+}
+
+func (pm *PreviewManager) getDistributionTags(ctx context.Context, distributionARN string) (map[string]string, error) {
+	result, err := pm.cfClient.ListTagsForResource(ctx, &cloudfront.ListTagsForResourceInput{
+		Resource: aws.String(distributionARN),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list distribution tags: %w", err)
+	}
+
+	tags := make(map[string]string)
+	if result.Tags != nil {
+		for _, tag := range result.Tags.Items {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return tags, nil
+}
+
+// tagDistributionRepo tags the distribution with the repository deploying
+// it. Distributions created before the tag existed get it on their next
+// deploy.
+func (pm *PreviewManager) tagDistributionRepo(ctx context.Context, distributionID string) error {
+	repo := pm.repo()
+	if repo == "" {
+		return nil
+	}
+
+	dist, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+		Id: aws.String(distributionID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get distribution: %w", err)
+	}
+
+	_, err = pm.cfClient.TagResource(ctx, &cloudfront.TagResourceInput{
+		Resource: dist.Distribution.ARN,
+		Tags: &cftypes.Tags{
+			Items: []cftypes.Tag{
+				{
+					Key:   aws.String(repoTag),
+					Value: aws.String(repo),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to tag distribution: %w", err)
+	}
+	return nil
+}
+
+func (pm *PreviewManager) markPendingDeletion(ctx context.Context, distributionARN string) error {
+	_, err := pm.cfClient.TagResource(ctx, &cloudfront.TagResourceInput{
+		Resource: aws.String(distributionARN),
+		Tags: &cftypes.Tags{
+			Items: []cftypes.Tag{
+				{
+					Key:   aws.String(pendingDeletionTag),
+					Value: aws.String(time.Now().UTC().Format(time.RFC3339)),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to tag distribution for deletion: %w", err)
+	}
+	return nil
+}
+
+func (pm *PreviewManager) clearPendingDeletion(ctx context.Context, distributionARN string) error {
+	_, err := pm.cfClient.UntagResource(ctx, &cloudfront.UntagResourceInput{
+		Resource: aws.String(distributionARN),
+		TagKeys: &cftypes.TagKeys{
+			Items: []string{pendingDeletionTag},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to untag distribution: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// bucketCheck is one hardening setting of a preview bucket.
+type bucketCheck struct {
+	Name  string
+	Check func(ctx context.Context, bucket string) (string, error)
+}
+
+// Doctor checks preview buckets for the settings hardenBucket applies and
+// fails when any is missing. Without --pr every preview bucket is checked.
+func (pm *PreviewManager) Doctor(ctx context.Context) error {
+	buckets := []string{pm.bucketName}
+	if pm.cfg.PRNumber == 0 {
+		var err error
+		if buckets, err = pm.listPreviewBuckets(ctx); err != nil {
+			return err
+		}
+	}
+
+	checks := []bucketCheck{
+		{"PUBLIC ACCESS", pm.checkPublicAccessBlock},
+		{"OWNERSHIP", pm.checkOwnership},
+		{"ENCRYPTION", pm.checkEncryption},
+		{"TLS ONLY", pm.checkTLSOnly},
+		{"LIFECYCLE", pm.checkLifecycle},
+	}
+
+	names := []string{"BUCKET"}
+	for _, check := range checks {
+		names = append(names, check.Name)
+	}
+
+	w := newTableWriter(pm.out)
+	fmt.Fprintln(w, strings.Join(names, "\t"))
+	unhealthy := 0
+	for _, bucket := range buckets {
+		row := []string{bucket}
+		healthy := true
+		for _, check := range checks {
+			problem, err := check.Check(ctx, bucket)
+			switch {
+			case err != nil:
+				row = append(row, "error: "+err.Error())
+				healthy = false
+			case problem != "":
+				row = append(row, problem)
+				healthy = false
+			default:
+				row = append(row, "ok")
+			}
+		}
+		if !healthy {
+			unhealthy++
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if unhealthy > 0 {
+		return fmt.Errorf("%d of %d bucket(s) are not hardened, redeploy their previews to fix them", unhealthy, len(buckets))
+	}
+	fmt.Fprintf(pm.out, "\n✓ All %d bucket(s) are hardened\n", len(buckets))
+	return nil
+}
+
+func (pm *PreviewManager) listPreviewBuckets(ctx context.Context) ([]string, error) {
+	var buckets []string
+	paginator := s3.NewListBucketsPaginator(pm.s3Client, &s3.ListBucketsInput{
+		Prefix:       aws.String("pr-"),
+		BucketRegion: aws.String(pm.cfg.Region),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list buckets: %w", err)
+		}
+		for _, bucket := range page.Buckets {
+			if previewNamePattern.MatchString(aws.ToString(bucket.Name)) {
+				buckets = append(buckets, aws.ToString(bucket.Name))
+			}
+		}
+	}
+	return buckets, nil
+}
+
+func (pm *PreviewManager) checkPublicAccessBlock(ctx context.Context, bucket string) (string, error) {
+	result, err := pm.s3Client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: aws.String(bucket)})
+	if isNotConfigured(err) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	c := result.PublicAccessBlockConfiguration
+	if !aws.ToBool(c.BlockPublicAcls) || !aws.ToBool(c.BlockPublicPolicy) ||
+		!aws.ToBool(c.IgnorePublicAcls) || !aws.ToBool(c.RestrictPublicBuckets) {
+		return "partial", nil
+	}
+	return "", nil
+}
+
+func (pm *PreviewManager) checkOwnership(ctx context.Context, bucket string) (string, error) {
+	result, err := pm.s3Client.GetBucketOwnershipControls(ctx, &s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucket)})
+	if isNotConfigured(err) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range result.OwnershipControls.Rules {
+		if rule.ObjectOwnership != s3types.ObjectOwnershipBucketOwnerEnforced {
+			return string(rule.ObjectOwnership), nil
+		}
+	}
+	return "", nil
+}
+
+func (pm *PreviewManager) checkEncryption(ctx context.Context, bucket string) (string, error) {
+	result, err := pm.s3Client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: aws.String(bucket)})
+	if isNotConfigured(err) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	want := pm.encryptionRule().ApplyServerSideEncryptionByDefault
+	for _, rule := range result.ServerSideEncryptionConfiguration.Rules {
+		got := rule.ApplyServerSideEncryptionByDefault
+		if got == nil {
+			continue
+		}
+		if got.SSEAlgorithm != want.SSEAlgorithm {
+			return string(got.SSEAlgorithm), nil
+		}
+		if want.KMSMasterKeyID != nil && !strings.HasSuffix(aws.ToString(got.KMSMasterKeyID), aws.ToString(want.KMSMasterKeyID)) {
+			return "other KMS key", nil
+		}
+		return "", nil
+	}
+	return "missing", nil
+}
+
+func (pm *PreviewManager) checkTLSOnly(ctx context.Context, bucket string) (string, error) {
+	policy, err := pm.getBucketPolicy(ctx, bucket)
+	if err != nil {
+		return "", err
+	}
+	if policy.statement(denyInsecureTransportSid) == nil {
+		return "missing", nil
+	}
+	return "", nil
+}
+
+func (pm *PreviewManager) checkLifecycle(ctx context.Context, bucket string) (string, error) {
+	result, err := pm.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+	if isNotConfigured(err) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range result.Rules {
+		if rule.Status == s3types.ExpirationStatusEnabled && rule.AbortIncompleteMultipartUpload != nil {
+			return "", nil
+		}
+	}
+	return "missing", nil
+}
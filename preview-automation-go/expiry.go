@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/v66/github"
+)
+
+// Bucket tags recording when a preview expires.
+const (
+	expiresAtTag    = "preview:expires-at"
+	lastDeployedTag = "preview:last-deployed"
+	ttlTag          = "preview:ttl"
+	expiryWarnedTag = "preview:expiry-warned"
+)
+
+// expiryWarningWindow is how long before expiry the PR gets a warning.
+const expiryWarningWindow = 24 * time.Hour
+
+// previewExpiry is the expiry metadata stored on a preview bucket.
+type previewExpiry struct {
+	ExpiresAt time.Time
+	TTL       time.Duration
+	Warned    bool
+}
+
+func (pm *PreviewManager) getExpiry(ctx context.Context) (*previewExpiry, error) {
+	tags, err := pm.getBucketTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return expiryFromTags(tags), nil
+}
+
+func expiryFromTags(tags map[string]string) *previewExpiry {
+	expiresAt, err := time.Parse(time.RFC3339, tags[expiresAtTag])
+	if err != nil {
+		return nil
+	}
+
+	ttl, _ := parseDuration(tags[ttlTag])
+	_, warned := tags[expiryWarnedTag]
+	return &previewExpiry{ExpiresAt: expiresAt, TTL: ttl, Warned: warned}
+}
+
+// renewExpiry pushes the expiry of the preview to ttl from now.
+func (pm *PreviewManager) renewExpiry(ctx context.Context, ttl time.Duration) (time.Time, error) {
+	expiresAt := time.Now().UTC().Add(ttl).Truncate(time.Second)
+
+	err := pm.updateBucketTags(ctx, map[string]string{
+		expiresAtTag: expiresAt.Format(time.RFC3339),
+		ttlTag:       formatDuration(ttl),
+	}, expiryWarnedTag)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return expiresAt, nil
+}
+
+// recordDeploy records the deploy on the preview bucket and renews its
+// expiry when a TTL is configured, so only previews nobody pushes to expire.
+// Deploying also wakes a sleeping preview.
+func (pm *PreviewManager) recordDeploy(ctx context.Context) error {
+	now := time.Now().UTC()
+	set := map[string]string{
+		lastDeployedTag: now.Format(time.RFC3339),
+	}
+	remove := []string{previewStateTag, expiryWarnedTag}
+	if repo := pm.repo(); repo != "" {
+		set[repoTag] = repo
+	}
+
+	if pm.cfg.TTL > 0 {
+		pm.expiresAt = now.Add(pm.cfg.TTL).Truncate(time.Second)
+		set[expiresAtTag] = pm.expiresAt.Format(time.RFC3339)
+		set[ttlTag] = formatDuration(pm.cfg.TTL)
+	} else {
+		remove = append(remove, expiresAtTag, ttlTag)
+	}
+
+	if err := pm.updateBucketTags(ctx, set, remove...); err != nil {
+		return err
+	}
+
+	if !pm.expiresAt.IsZero() {
+		fmt.Fprintf(pm.out, "  ✓ Preview expires at %s (TTL %s)\n", pm.expiresAt.Format(time.RFC3339), formatDuration(pm.cfg.TTL))
+	}
+	return nil
+}
+
+// Extend renews the expiry of an existing preview, e.g. from a
+// "/preview extend" PR comment. The TTL flag wins over the TTL stored at the
+// last deploy.
+func (pm *PreviewManager) Extend(ctx context.Context) error {
+	fmt.Fprintf(pm.out, "Extending preview %s...\n", pm.bucketName)
+
+	expiry, err := pm.getExpiry(ctx)
+	if err != nil {
+		return err
+	}
+
+	ttl := pm.cfg.TTL
+	if ttl <= 0 && expiry != nil {
+		ttl = expiry.TTL
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("preview %s has no TTL, set --ttl", pm.bucketName)
+	}
+
+	expiresAt, err := pm.renewExpiry(ctx, ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ Preview expires at %s\n", expiresAt.Format(time.RFC3339))
+
+	err = pm.updateRecord(ctx, func(r *previewRecord) {
+		r.ExpiresAt = &expiresAt
+		r.TTL = formatDuration(ttl)
+		r.ExpiryWarned = false
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update preview registry: %w", err)
+	}
+
+	if err := pm.postExpiryComment(ctx, fmt.Sprintf(`## Preview Environment Extended ⏳
+
+The preview at **https://%s** now expires on %s.`, pm.fullDomain, expiresAt.Format(time.RFC1123))); err != nil {
+		fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
+	}
+
+	return nil
+}
+
+// warnExpiry posts the expiry warning on the PR and records that it was sent
+// so later gc runs stay quiet.
+func (pm *PreviewManager) warnExpiry(ctx context.Context, expiresAt time.Time) error {
+	fmt.Fprintf(pm.out, "Warning PR #%d that %s expires at %s\n", pm.cfg.PRNumber, pm.bucketName, expiresAt.Format(time.RFC3339))
+
+	err := pm.postExpiryComment(ctx, fmt.Sprintf(`## Preview Environment Expiring Soon ⏰
+
+The preview at **https://%s** has not been updated recently and will be removed on %s.
+
+Push a new commit or comment `+"`/preview extend`"+` to keep it.`, pm.fullDomain, expiresAt.Format(time.RFC1123)))
+	if err != nil {
+		return err
+	}
+
+	err = pm.updateBucketTags(ctx, map[string]string{
+		expiryWarnedTag: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	return pm.updateRecord(ctx, func(r *previewRecord) {
+		r.ExpiryWarned = true
+	})
+}
+
+func (pm *PreviewManager) postExpiredComment(ctx context.Context) error {
+	if pm.githubClient == nil {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
+		return nil
+	}
+
+	return pm.upsertGitHubComment(ctx, `## Preview Environment Expired 💤
+
+This preview was removed after its time-to-live passed without new commits.
+
+Push a new commit to deploy it again.`)
+}
+
+// postExpiryComment adds a new comment rather than editing the preview
+// comment, so the PR author is notified.
+func (pm *PreviewManager) postExpiryComment(ctx context.Context, body string) error {
+	if pm.githubClient == nil {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
+		return nil
+	}
+
+	comment := &github.IssueComment{
+		Body: github.String(body),
+	}
+
+	_, _, err := pm.githubClient.Issues.CreateComment(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber, comment)
+	if err != nil {
+		return fmt.Errorf("failed to create comment: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ GitHub PR comment posted")
+	return nil
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// previewNamePattern matches previewName output: pr-{number}-{app}.
+var previewNamePattern = regexp.MustCompile(`^pr-(\d+)-([a-z0-9][a-z0-9-]*)$`)
+
+type previewKey struct {
+	PRNumber int
+	AppName  string
+}
+
+// discoveredPreview collects the resources found for one preview while
+// scanning the account.
+type discoveredPreview struct {
+	previewKey
+	// Repo is the owner/repo that deployed the preview, "" when untagged.
+	Repo            string
+	Bucket          bool
+	DistributionID  string
+	DistributionARN string
+	DNSRecords      int
+	OACID           string
+	CreatedAt       time.Time
+	Expiry          *previewExpiry
+}
+
+func (d *discoveredPreview) resources() string {
+	var parts []string
+	if d.Bucket {
+		parts = append(parts, "bucket")
+	}
+	if d.DistributionID != "" {
+		parts = append(parts, "distribution")
+	}
+	if d.DNSRecords > 0 {
+		parts = append(parts, "dns")
+	}
+	if d.OACID != "" {
+		parts = append(parts, "oac")
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d *discoveredPreview) observe(created time.Time) {
+	if created.IsZero() {
+		return
+	}
+	if d.CreatedAt.IsZero() || created.Before(d.CreatedAt) {
+		d.CreatedAt = created
+	}
+}
+
+type gcDecision struct {
+	Preview *discoveredPreview
+	Delete  bool
+	Expired bool
+	Warn    bool
+	Reason  string
+	Err     error
+}
+
+// GarbageCollect deletes distributions that an asynchronous cleanup disabled
+// and tears down previews whose PR is closed, whose TTL has passed or that
+// exceed the max age. Open previews about to expire get a warning comment.
+// Finally it deletes the viewer-request functions and response headers
+// policies no distribution uses.
+func (pm *PreviewManager) GarbageCollect(ctx context.Context) error {
+	fmt.Fprintln(pm.out, "Starting garbage collection...")
+
+	var err error
+	switch {
+	case pm.cfg.DryRun:
+		fmt.Fprintln(pm.out, "  Dry run: nothing will be deleted")
+	case pm.registry != nil:
+		err = pm.deletePendingRecords(ctx)
+	default:
+		err = pm.deletePendingDistributions(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	var previews []*discoveredPreview
+	if pm.registry != nil {
+		previews, err = pm.previewsFromRegistry(ctx)
+	} else {
+		previews, err = pm.discoverPreviews(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Previews of other repositories sharing the account, domain or
+	// registry are theirs to collect.
+	repo := pm.repo()
+	others := 0
+	previews = slices.DeleteFunc(previews, func(p *discoveredPreview) bool {
+		other := p.Repo != "" && p.Repo != repo
+		if other {
+			others++
+		}
+		return other
+	})
+	if others > 0 {
+		fmt.Fprintf(pm.out, "  Ignoring %d preview(s) of other repositories\n", others)
+	}
+
+	var decisions []gcDecision
+	prStates := make(map[int]string)
+	for _, preview := range previews {
+		decision := pm.decide(ctx, preview, prStates)
+		if decision.Err == nil && !pm.cfg.DryRun {
+			decision.Err = pm.apply(ctx, decision)
+		}
+		decisions = append(decisions, decision)
+	}
+
+	if !pm.cfg.DryRun {
+		if err := pm.deleteUnusedFunctions(ctx); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: %v\n", err)
+		}
+		if err := pm.deleteUnusedResponseHeadersPolicies(ctx); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: %v\n", err)
+		}
+	}
+
+	return pm.printGCReport(decisions)
+}
+
+func (pm *PreviewManager) apply(ctx context.Context, decision gcDecision) error {
+	preview := decision.Preview
+	target := pm.forPreview(preview.PRNumber, preview.AppName)
+
+	if !decision.Warn && !decision.Delete {
+		return nil
+	}
+
+	// A preview that is being deployed or cleaned up is left to the next run
+	// rather than holding up the whole collection.
+	target.cfg.LockTimeout = 0
+	return target.withLock(ctx, nil, func(ctx context.Context) error {
+		if decision.Warn {
+			return target.warnExpiry(ctx, preview.Expiry.ExpiresAt)
+		}
+
+		fmt.Fprintf(pm.out, "Tearing down %s (%s)...\n", target.bucketName, decision.Reason)
+		if err := target.teardown(ctx); err != nil {
+			return err
+		}
+
+		if decision.Expired {
+			if err := target.postExpiredComment(ctx); err != nil {
+				fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (pm *PreviewManager) decide(ctx context.Context, preview *discoveredPreview, prStates map[int]string) gcDecision {
+	decision := gcDecision{Preview: preview, Reason: "PR open"}
+
+	// Untagged previews may belong to any repository sharing the account,
+	// so their age says nothing, and only with --collect-untagged does a
+	// closed PR of this repository count.
+	untagged := preview.Repo == ""
+	if untagged && !pm.cfg.CollectUntagged {
+		decision.Reason = "untagged"
+		return decision
+	}
+
+	if pm.cfg.MaxAge > 0 && !preview.CreatedAt.IsZero() && !untagged {
+		if age := time.Since(preview.CreatedAt); age > pm.cfg.MaxAge {
+			decision.Delete = true
+			decision.Reason = fmt.Sprintf("older than %s (%s)", formatDuration(pm.cfg.MaxAge), age.Round(time.Hour))
+			return decision
+		}
+	}
+
+	if preview.Expiry != nil && time.Now().After(preview.Expiry.ExpiresAt) {
+		decision.Delete = true
+		decision.Expired = true
+		decision.Reason = fmt.Sprintf("expired at %s", preview.Expiry.ExpiresAt.Format(time.RFC3339))
+		return decision
+	}
+
+	if pm.githubClient == nil {
+		decision.Reason = "PR state unknown (no GitHub token)"
+		return decision
+	}
+
+	state, ok := prStates[preview.PRNumber]
+	if !ok {
+		pr, resp, err := pm.githubClient.PullRequests.Get(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, preview.PRNumber)
+		switch {
+		case resp != nil && resp.StatusCode == 404:
+			state = "not found"
+		case err != nil:
+			decision.Err = fmt.Errorf("failed to get PR #%d: %w", preview.PRNumber, err)
+			return decision
+		default:
+			state = pr.GetState()
+		}
+		prStates[preview.PRNumber] = state
+	}
+
+	switch state {
+	case "closed":
+		decision.Delete = true
+		decision.Reason = "PR closed"
+		if untagged {
+			decision.Reason = "untagged, PR closed in this repository"
+		}
+	case "not found":
+		decision.Reason = "PR not found in this repository"
+	case "open":
+		if expiry := preview.Expiry; expiry != nil {
+			decision.Reason = fmt.Sprintf("PR open, expires at %s", expiry.ExpiresAt.Format(time.RFC3339))
+			if !expiry.Warned && time.Until(expiry.ExpiresAt) < expiryWarningWindow {
+				decision.Warn = true
+			}
+		}
+	}
+	return decision
+}
+
+// printUntaggedHint lists the commands removing the untagged previews gc
+// kept, since their PR may be closed and they would never be collected.
+func (pm *PreviewManager) printUntaggedHint(decisions []gcDecision) {
+	var commands []string
+	for _, d := range decisions {
+		if d.Preview.Repo == "" && !d.Delete && d.Err == nil {
+			commands = append(commands, fmt.Sprintf("  preview-tool --action cleanup --pr %d --app %s --repo-owner %s --repo-name %s",
+				d.Preview.PRNumber, d.Preview.AppName, pm.cfg.RepoOwner, pm.cfg.RepoName))
+		}
+	}
+	if len(commands) == 0 {
+		return
+	}
+
+	fmt.Fprintln(pm.out, "\nUntagged previews may belong to another repository sharing the account. Run gc with")
+	fmt.Fprintln(pm.out, "--collect-untagged to tear down those whose PR in this repository is closed, or remove one with:")
+	for _, command := range commands {
+		fmt.Fprintln(pm.out, command)
+	}
+}
+
+// parsePreviewName returns the preview a previewName belongs to.
+func parsePreviewName(name string) (previewKey, bool) {
+	m := previewNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return previewKey{}, false
+	}
+	prNumber, err := strconv.Atoi(m[1])
+	if err != nil {
+		return previewKey{}, false
+	}
+	return previewKey{PRNumber: prNumber, AppName: m[2]}, true
+}
+
+// distributionPreview returns the preview whose domain is an alias of the
+// distribution.
+func (pm *PreviewManager) distributionPreview(dist cftypes.DistributionSummary) (previewKey, bool) {
+	if dist.Aliases == nil {
+		return previewKey{}, false
+	}
+	domainSuffix := "." + normalizeDNSName(pm.cfg.BaseDomain)
+	for _, alias := range dist.Aliases.Items {
+		name, ok := strings.CutSuffix(normalizeDNSName(alias), domainSuffix)
+		if !ok {
+			continue
+		}
+		if key, ok := parsePreviewName(name); ok {
+			return key, true
+		}
+	}
+	return previewKey{}, false
+}
+
+// discoverPreviews scans buckets, distributions, DNS records and OACs for
+// resources named after a preview.
+func (pm *PreviewManager) discoverPreviews(ctx context.Context) ([]*discoveredPreview, error) {
+	fmt.Fprintln(pm.out, "Discovering preview resources...")
+
+	previews := make(map[previewKey]*discoveredPreview)
+	get := func(name string) *discoveredPreview {
+		key, ok := parsePreviewName(name)
+		if !ok {
+			return nil
+		}
+		if previews[key] == nil {
+			previews[key] = &discoveredPreview{previewKey: key}
+		}
+		return previews[key]
+	}
+
+	bucketPaginator := s3.NewListBucketsPaginator(pm.s3Client, &s3.ListBucketsInput{
+		Prefix: aws.String("pr-"),
+	})
+	for bucketPaginator.HasMorePages() {
+		page, err := bucketPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list buckets: %w", err)
+		}
+		for _, bucket := range page.Buckets {
+			if preview := get(aws.ToString(bucket.Name)); preview != nil {
+				preview.Bucket = true
+				preview.observe(aws.ToTime(bucket.CreationDate))
+			}
+		}
+	}
+
+	distributions, err := pm.listDistributions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, dist := range distributions {
+		key, ok := pm.distributionPreview(dist)
+		if !ok {
+			continue
+		}
+		preview := get(previewName(key.PRNumber, key.AppName))
+		preview.DistributionID = aws.ToString(dist.Id)
+		preview.DistributionARN = aws.ToString(dist.ARN)
+		preview.observe(aws.ToTime(dist.LastModifiedTime))
+	}
+
+	hostedZoneID, err := pm.getHostedZoneID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	domainSuffix := "." + normalizeDNSName(pm.cfg.BaseDomain)
+	recordPaginator := route53.NewListResourceRecordSetsPaginator(pm.r53Client, &route53.ListResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+	})
+	for recordPaginator.HasMorePages() {
+		page, err := recordPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list records: %w", err)
+		}
+		for _, recordSet := range page.ResourceRecordSets {
+			name, ok := strings.CutSuffix(normalizeDNSName(aws.ToString(recordSet.Name)), domainSuffix)
+			if !ok {
+				continue
+			}
+			if preview := get(name); preview != nil {
+				preview.DNSRecords++
+			}
+		}
+	}
+
+	oacs, err := pm.listOriginAccessControls(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, oac := range oacs {
+		name, ok := strings.CutPrefix(aws.ToString(oac.Name), "OAC-")
+		if !ok {
+			continue
+		}
+		if preview := get(name); preview != nil {
+			preview.OACID = aws.ToString(oac.Id)
+		}
+	}
+
+	var result []*discoveredPreview
+	for _, preview := range previews {
+		if preview.Bucket {
+			tags, err := pm.forPreview(preview.PRNumber, preview.AppName).getBucketTags(ctx)
+			if err != nil {
+				fmt.Fprintf(pm.out, "  Warning: %v\n", err)
+			} else {
+				preview.Expiry = expiryFromTags(tags)
+				preview.Repo = tags[repoTag]
+			}
+		}
+		if preview.Repo == "" && preview.DistributionARN != "" {
+			tags, err := pm.getDistributionTags(ctx, preview.DistributionARN)
+			if err != nil {
+				fmt.Fprintf(pm.out, "  Warning: %v\n", err)
+			} else {
+				preview.Repo = tags[repoTag]
+			}
+		}
+		result = append(result, preview)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].PRNumber != result[j].PRNumber {
+			return result[i].PRNumber < result[j].PRNumber
+		}
+		return result[i].AppName < result[j].AppName
+	})
+
+	fmt.Fprintf(pm.out, "  ✓ Found %d preview(s)\n", len(result))
+	return result, nil
+}
+
+func (pm *PreviewManager) printGCReport(decisions []gcDecision) error {
+	fmt.Fprintln(pm.out, "\nGarbage collection report:")
+
+	w := newTableWriter(pm.out)
+	fmt.Fprintln(w, "PREVIEW\tRESOURCES\tACTION\tREASON")
+
+	failed := 0
+	for _, d := range decisions {
+		action := "keep"
+		switch {
+		case d.Err != nil:
+			action = "error"
+			failed++
+		case d.Preview.Repo == "" && !d.Delete:
+			action = "unknown"
+		case d.Delete && pm.cfg.DryRun:
+			action = "would delete"
+		case d.Delete:
+			action = "deleted"
+		case d.Warn && pm.cfg.DryRun:
+			action = "would warn"
+		case d.Warn:
+			action = "warned"
+		}
+
+		reason := d.Reason
+		if d.Err != nil {
+			reason = fmt.Sprintf("%s: %v", reason, d.Err)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", previewName(d.Preview.PRNumber, d.Preview.AppName), d.Preview.resources(), action, reason)
+	}
+	w.Flush()
+
+	pm.printUntaggedHint(decisions)
+
+	if failed > 0 {
+		return fmt.Errorf("%d preview(s) could not be processed", failed)
+	}
+	return nil
+}
+
+// previewsFromRegistry returns the live previews recorded in the registry,
+// plus the discovered previews that have no record, e.g. deployed before the
+// registry existed.
+func (pm *PreviewManager) previewsFromRegistry(ctx context.Context) ([]*discoveredPreview, error) {
+	fmt.Fprintln(pm.out, "Reading previews from registry...")
+
+	records, err := pm.registry.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sortRecords(records)
+
+	var previews []*discoveredPreview
+	for _, r := range records {
+		if r.Status != recordActive && r.Status != recordSleeping {
+			continue
+		}
+		previews = append(previews, &discoveredPreview{
+			previewKey:     r.key(),
+			Repo:           r.Repo,
+			Bucket:         true,
+			DistributionID: r.DistributionID,
+			OACID:          r.OACID,
+			CreatedAt:      r.CreatedAt,
+			Expiry:         r.expiry(),
+		})
+	}
+	fmt.Fprintf(pm.out, "  ✓ Found %d preview(s)\n", len(previews))
+
+	discovered, err := pm.discoverPreviews(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[previewKey]bool, len(records))
+	for _, r := range records {
+		recorded[r.key()] = true
+	}
+	unrecorded := 0
+	for _, preview := range discovered {
+		if !recorded[preview.previewKey] {
+			previews = append(previews, preview)
+			unrecorded++
+		}
+	}
+	fmt.Fprintf(pm.out, "  ✓ %d of them have no registry record\n", unrecorded)
+
+	return previews, nil
+}
+
+// deletePendingRecords deletes the distributions of previews recorded as
+// deleting once they have finished disabling, along with their OAC.
+func (pm *PreviewManager) deletePendingRecords(ctx context.Context) error {
+	fmt.Fprintln(pm.out, "Deleting distributions pending deletion...")
+
+	records, err := pm.registry.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	deleted, waiting := 0, 0
+	for _, r := range records {
+		if r.Status != recordDeleting || (r.Repo != "" && r.Repo != pm.repo()) {
+			continue
+		}
+		target := pm.forPreview(r.PRNumber, r.AppName)
+
+		if r.DistributionID != "" {
+			dist, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+				Id: aws.String(r.DistributionID),
+			})
+			var noSuchDistribution *cftypes.NoSuchDistribution
+			switch {
+			case errors.As(err, &noSuchDistribution):
+			case err != nil:
+				return fmt.Errorf("failed to get distribution %s: %w", r.DistributionID, err)
+			case aws.ToString(dist.Distribution.Status) != "Deployed":
+				fmt.Fprintf(pm.out, "  %s is still being disabled\n", r.DistributionID)
+				waiting++
+				continue
+			default:
+				if err := pm.deleteDisabledDistribution(ctx, r.DistributionID); err != nil {
+					return fmt.Errorf("failed to delete distribution %s: %w", r.DistributionID, err)
+				}
+				fmt.Fprintf(pm.out, "  ✓ Deleted %s\n", r.DistributionID)
+			}
+		}
+
+		if err := target.deleteOriginAccessControl(ctx); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: Failed to delete OAC: %v\n", err)
+		}
+
+		err := target.updateRecord(ctx, func(r *previewRecord) {
+			now := time.Now().UTC()
+			r.Status = recordDeleted
+			r.DeletedAt = &now
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update preview registry: %w", err)
+		}
+		deleted++
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ %d distribution(s) deleted, %d still disabling\n", deleted, waiting)
+	return nil
+}
+
+func (pm *PreviewManager) deletePendingDistributions(ctx context.Context) error {
+	fmt.Fprintln(pm.out, "Deleting distributions pending deletion...")
+
+	distributions, err := pm.listDistributions(ctx)
+	if err != nil {
+		return err
+	}
+
+	deleted, waiting := 0, 0
+	for _, dist := range distributions {
+		if aws.ToBool(dist.Enabled) {
+			continue
+		}
+
+		tags, err := pm.getDistributionTags(ctx, *dist.ARN)
+		if err != nil {
+			return err
+		}
+
+		markedAt, pending := tags[pendingDeletionTag]
+		if repo := tags[repoTag]; !pending || (repo != "" && repo != pm.repo()) {
+			continue
+		}
+
+		if status := aws.ToString(dist.Status); status != "Deployed" {
+			fmt.Fprintf(pm.out, "  %s is still being disabled (%s, marked %s)\n", *dist.Id, status, markedAt)
+			waiting++
+			continue
+		}
+
+		if err := pm.deleteDisabledDistribution(ctx, *dist.Id); err != nil {
+			return fmt.Errorf("failed to delete distribution %s: %w", *dist.Id, err)
+		}
+
+		fmt.Fprintf(pm.out, "  ✓ Deleted %s (marked %s)\n", *dist.Id, markedAt)
+		deleted++
+
+		// Cleanup left the OAC in place while the distribution still used it.
+		if key, ok := pm.distributionPreview(dist); ok {
+			if err := pm.forPreview(key.PRNumber, key.AppName).deleteOriginAccessControl(ctx); err != nil {
+				fmt.Fprintf(pm.out, "  Warning: Failed to delete OAC: %v\n", err)
+			}
+		}
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ %d distribution(s) deleted, %d still disabling\n", deleted, waiting)
+	return nil
+}
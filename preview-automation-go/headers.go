@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+// robotsTxtKey is injected into builds without one when --noindex is set.
+const robotsTxtKey = "robots.txt"
+
+const noindexRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// responseHeaders is what the response headers policy of a preview sets.
+type responseHeaders struct {
+	Security bool              `json:"security"`
+	Noindex  bool              `json:"noindex"`
+	CSP      string            `json:"csp,omitempty"`
+	Custom   map[string]string `json:"custom,omitempty"`
+}
+
+func (pm *PreviewManager) responseHeaders() (*responseHeaders, error) {
+	custom, err := parseCustomHeaders(pm.cfg.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+	return &responseHeaders{
+		Security: pm.cfg.SecurityHeaders,
+		Noindex:  pm.cfg.Noindex,
+		CSP:      pm.cfg.CSP,
+		Custom:   custom,
+	}, nil
+}
+
+func (h *responseHeaders) empty() bool {
+	return !h.Security && !h.Noindex && h.CSP == "" && len(h.Custom) == 0
+}
+
+// parseCustomHeaders turns "Name: value" flags into a header map.
+func parseCustomHeaders(headers []string) (map[string]string, error) {
+	custom := make(map[string]string)
+	for _, header := range headers {
+		name, value, found := strings.Cut(header, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !found || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid response header %q, expected \"Name: value\"", header)
+		}
+		custom[http.CanonicalHeaderKey(name)] = value
+	}
+	return custom, nil
+}
+
+// policyConfig builds the response headers policy config named name.
+func (h *responseHeaders) policyConfig(name string) *cftypes.ResponseHeadersPolicyConfig {
+	cfg := &cftypes.ResponseHeadersPolicyConfig{
+		Name:    aws.String(name),
+		Comment: aws.String("PR preview response headers"),
+	}
+
+	security := &cftypes.ResponseHeadersPolicySecurityHeadersConfig{}
+	if h.Security {
+		security.StrictTransportSecurity = &cftypes.ResponseHeadersPolicyStrictTransportSecurity{
+			AccessControlMaxAgeSec: aws.Int32(31536000),
+			Override:               aws.Bool(true),
+		}
+		security.ContentTypeOptions = &cftypes.ResponseHeadersPolicyContentTypeOptions{
+			Override: aws.Bool(true),
+		}
+		security.ReferrerPolicy = &cftypes.ResponseHeadersPolicyReferrerPolicy{
+			ReferrerPolicy: cftypes.ReferrerPolicyListStrictOriginWhenCrossOrigin,
+			Override:       aws.Bool(true),
+		}
+		security.FrameOptions = &cftypes.ResponseHeadersPolicyFrameOptions{
+			FrameOption: cftypes.FrameOptionsListSameorigin,
+			Override:    aws.Bool(true),
+		}
+	}
+	if h.CSP != "" {
+		security.ContentSecurityPolicy = &cftypes.ResponseHeadersPolicyContentSecurityPolicy{
+			ContentSecurityPolicy: aws.String(h.CSP),
+			Override:              aws.Bool(true),
+		}
+	}
+	if h.Security || h.CSP != "" {
+		cfg.SecurityHeadersConfig = security
+	}
+
+	custom := make(map[string]string)
+	if h.Noindex {
+		custom["X-Robots-Tag"] = "noindex, nofollow"
+	}
+	for name, value := range h.Custom {
+		custom[name] = value
+	}
+
+	names := make([]string, 0, len(custom))
+	for name := range custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make([]cftypes.ResponseHeadersPolicyCustomHeader, 0, len(names))
+	for _, name := range names {
+		items = append(items, cftypes.ResponseHeadersPolicyCustomHeader{
+			Header:   aws.String(name),
+			Value:    aws.String(custom[name]),
+			Override: aws.Bool(true),
+		})
+	}
+	cfg.CustomHeadersConfig = &cftypes.ResponseHeadersPolicyCustomHeadersConfig{
+		Quantity: aws.Int32(int32(len(items))),
+		Items:    items,
+	}
+
+	return cfg
+}
+
+// headersPolicyPrefix starts the names of the response headers policies.
+const headersPolicyPrefix = "pr-preview-headers-"
+
+// ensureResponseHeadersPolicy returns the ID of the response headers policy
+// for the preview's header settings, creating it if needed. Like viewer-request
+// functions, policies are named after a hash of their settings and shared by
+// previews. Returns "" when no headers are configured.
+func (pm *PreviewManager) ensureResponseHeadersPolicy(ctx context.Context) (string, error) {
+	headers, err := pm.responseHeaders()
+	if err != nil {
+		return "", err
+	}
+	if headers.empty() {
+		return "", nil
+	}
+
+	settings, err := json.Marshal(headers)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode response headers: %w", err)
+	}
+	sum := sha256.Sum256(settings)
+	name := headersPolicyPrefix + hex.EncodeToString(sum[:])[:16]
+
+	fmt.Fprintf(pm.out, "Managing response headers policy %s...\n", name)
+
+	policyID, err := pm.findResponseHeadersPolicy(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if policyID != "" {
+		fmt.Fprintln(pm.out, "  ✓ Using existing response headers policy")
+		return policyID, nil
+	}
+
+	result, err := pm.cfClient.CreateResponseHeadersPolicy(ctx, &cloudfront.CreateResponseHeadersPolicyInput{
+		ResponseHeadersPolicyConfig: headers.policyConfig(name),
+	})
+	var alreadyExists *cftypes.ResponseHeadersPolicyAlreadyExists
+	if errors.As(err, &alreadyExists) {
+		// Another deploy created it in the meantime.
+		return pm.findResponseHeadersPolicy(ctx, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create response headers policy: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ Response headers policy created")
+	return aws.ToString(result.ResponseHeadersPolicy.Id), nil
+}
+
+func (pm *PreviewManager) findResponseHeadersPolicy(ctx context.Context, name string) (string, error) {
+	input := &cloudfront.ListResponseHeadersPoliciesInput{Type: cftypes.ResponseHeadersPolicyTypeCustom}
+	for {
+		result, err := pm.cfClient.ListResponseHeadersPolicies(ctx, input)
+		if err != nil {
+			return "", fmt.Errorf("failed to list response headers policies: %w", err)
+		}
+		list := result.ResponseHeadersPolicyList
+		if list == nil {
+			return "", nil
+		}
+		for _, summary := range list.Items {
+			policy := summary.ResponseHeadersPolicy
+			if policy != nil && policy.ResponseHeadersPolicyConfig != nil &&
+				aws.ToString(policy.ResponseHeadersPolicyConfig.Name) == name {
+				return aws.ToString(policy.Id), nil
+			}
+		}
+		if aws.ToString(list.NextMarker) == "" {
+			return "", nil
+		}
+		input.Marker = list.NextMarker
+	}
+}
+
+// deleteUnusedResponseHeadersPolicies deletes the response headers policies
+// that no distribution uses, since an account can only have a few.
+func (pm *PreviewManager) deleteUnusedResponseHeadersPolicies(ctx context.Context) error {
+	fmt.Fprintln(pm.out, "Deleting unused response headers policies...")
+
+	distributions, err := pm.listDistributions(ctx)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, dist := range distributions {
+		if dist.DefaultCacheBehavior != nil {
+			used[aws.ToString(dist.DefaultCacheBehavior.ResponseHeadersPolicyId)] = true
+		}
+		if dist.CacheBehaviors != nil {
+			for _, behavior := range dist.CacheBehaviors.Items {
+				used[aws.ToString(behavior.ResponseHeadersPolicyId)] = true
+			}
+		}
+	}
+
+	var unused []cftypes.ResponseHeadersPolicy
+	input := &cloudfront.ListResponseHeadersPoliciesInput{Type: cftypes.ResponseHeadersPolicyTypeCustom}
+	for {
+		result, err := pm.cfClient.ListResponseHeadersPolicies(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to list response headers policies: %w", err)
+		}
+		list := result.ResponseHeadersPolicyList
+		if list == nil {
+			break
+		}
+		for _, summary := range list.Items {
+			policy := summary.ResponseHeadersPolicy
+			if policy == nil || policy.ResponseHeadersPolicyConfig == nil ||
+				!strings.HasPrefix(aws.ToString(policy.ResponseHeadersPolicyConfig.Name), headersPolicyPrefix) ||
+				used[aws.ToString(policy.Id)] || time.Since(aws.ToTime(policy.LastModifiedTime)) < unusedGracePeriod {
+				continue
+			}
+			unused = append(unused, *policy)
+		}
+		if aws.ToString(list.NextMarker) == "" {
+			break
+		}
+		input.Marker = list.NextMarker
+	}
+
+	deleted := 0
+	for _, policy := range unused {
+		name := aws.ToString(policy.ResponseHeadersPolicyConfig.Name)
+		if err := pm.deleteResponseHeadersPolicy(ctx, aws.ToString(policy.Id)); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: Failed to delete %s: %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(pm.out, "  ✓ Deleted %s\n", name)
+		deleted++
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ %d policy(ies) deleted\n", deleted)
+	return nil
+}
+
+func (pm *PreviewManager) deleteResponseHeadersPolicy(ctx context.Context, id string) error {
+	policy, err := pm.cfClient.GetResponseHeadersPolicy(ctx, &cloudfront.GetResponseHeadersPolicyInput{
+		Id: aws.String(id),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get response headers policy: %w", err)
+	}
+
+	_, err = pm.cfClient.DeleteResponseHeadersPolicy(ctx, &cloudfront.DeleteResponseHeadersPolicyInput{
+		Id:      aws.String(id),
+		IfMatch: policy.ETag,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete response headers policy: %w", err)
+	}
+	return nil
+}
+
+// optionalString returns nil for "", for config fields CloudFront expects to
+// be absent rather than empty.
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
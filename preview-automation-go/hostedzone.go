@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// getHostedZoneID resolves the hosted zone that the preview records belong
+// in. The result is cached for the lifetime of the PreviewManager.
+func (pm *PreviewManager) getHostedZoneID(ctx context.Context) (string, error) {
+	if pm.hostedZoneID != "" {
+		return pm.hostedZoneID, nil
+	}
+
+	var zoneID string
+	var err error
+	if pm.cfg.HostedZoneID != "" {
+		zoneID, err = pm.verifyHostedZone(ctx, pm.cfg.HostedZoneID)
+	} else {
+		zoneID, err = pm.findHostedZone(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	pm.hostedZoneID = zoneID
+	return zoneID, nil
+}
+
+// verifyHostedZone checks that an explicitly configured zone can hold the
+// preview domain.
+func (pm *PreviewManager) verifyHostedZone(ctx context.Context, zoneID string) (string, error) {
+	zoneID = trimHostedZoneID(zoneID)
+
+	result, err := pm.r53Client.GetHostedZone(ctx, &route53.GetHostedZoneInput{
+		Id: aws.String(zoneID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get hosted zone %s: %w", zoneID, err)
+	}
+
+	zoneName := normalizeDNSName(*result.HostedZone.Name)
+	if !domainInZone(pm.fullDomain, zoneName) {
+		return "", fmt.Errorf("hosted zone %s (%s) cannot contain %s", zoneID, zoneName, pm.fullDomain)
+	}
+
+	return zoneID, nil
+}
+
+// findHostedZone looks for a zone named exactly after the base domain, then
+// after each of its parents, so previews can live under a subdomain of an
+// existing zone. More than one matching zone is an error.
+func (pm *PreviewManager) findHostedZone(ctx context.Context) (string, error) {
+	visibility := "public"
+	if pm.cfg.PrivateZone {
+		visibility = "private"
+	}
+
+	for _, name := range parentDomains(pm.cfg.BaseDomain) {
+		zones, err := pm.listHostedZonesNamed(ctx, name)
+		if err != nil {
+			return "", err
+		}
+
+		matches := matchingZones(zones, pm.cfg.PrivateZone)
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			fmt.Fprintf(pm.out, "  Using %s hosted zone %s (%s)\n", visibility, matches[0], name)
+			return matches[0], nil
+		default:
+			return "", fmt.Errorf("found %d %s hosted zones named %s (%s), set --hosted-zone-id to choose one",
+				len(matches), visibility, name, strings.Join(matches, ", "))
+		}
+	}
+
+	return "", fmt.Errorf("no %s hosted zone found for domain: %s", visibility, pm.cfg.BaseDomain)
+}
+
+// matchingZones returns the IDs of the zones with the requested visibility.
+func matchingZones(zones []r53types.HostedZone, private bool) []string {
+	var matches []string
+	for _, zone := range zones {
+		if (zone.Config != nil && zone.Config.PrivateZone) == private {
+			matches = append(matches, trimHostedZoneID(aws.ToString(zone.Id)))
+		}
+	}
+	return matches
+}
+
+// listHostedZonesNamed returns every hosted zone whose name is exactly name.
+func (pm *PreviewManager) listHostedZonesNamed(ctx context.Context, name string) ([]r53types.HostedZone, error) {
+	var zones []r53types.HostedZone
+
+	input := &route53.ListHostedZonesByNameInput{
+		DNSName: aws.String(name),
+	}
+
+	for {
+		result, err := pm.r53Client.ListHostedZonesByName(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list hosted zones: %w", err)
+		}
+
+		// Zones are returned in name order starting at DNSName, so the first
+		// zone with a different name ends the matches.
+		for _, zone := range result.HostedZones {
+			if normalizeDNSName(*zone.Name) != name {
+				return zones, nil
+			}
+			zones = append(zones, zone)
+		}
+
+		if !result.IsTruncated {
+			return zones, nil
+		}
+
+		input.DNSName = result.NextDNSName
+		input.HostedZoneId = result.NextHostedZoneId
+	}
+}
+
+// parentDomains returns domain followed by each of its parent domains,
+// excluding the top-level domain.
+func parentDomains(domain string) []string {
+	labels := strings.Split(normalizeDNSName(domain), ".")
+
+	var domains []string
+	for i := 0; i < len(labels)-1; i++ {
+		domains = append(domains, strings.Join(labels[i:], "."))
+	}
+	return domains
+}
+
+func domainInZone(domain, zoneName string) bool {
+	domain = normalizeDNSName(domain)
+	return domain == zoneName || strings.HasSuffix(domain, "."+zoneName)
+}
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+func trimHostedZoneID(zoneID string) string {
+	parts := strings.Split(zoneID, "/")
+	return parts[len(parts)-1]
+}
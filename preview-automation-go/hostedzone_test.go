@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+func TestParentDomains(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   []string
+	}{
+		{"example.com", []string{"example.com"}},
+		{"previews.dev.example.com.", []string{"previews.dev.example.com", "dev.example.com", "example.com"}},
+		{" Preview.Example.COM ", []string{"preview.example.com", "example.com"}},
+		{"localhost", nil},
+	}
+	for _, tt := range tests {
+		if got := parentDomains(tt.domain); !slices.Equal(got, tt.want) {
+			t.Errorf("parentDomains(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestDomainInZone(t *testing.T) {
+	tests := []struct {
+		domain, zone string
+		want         bool
+	}{
+		{"pr-1-web.example.com", "example.com", true},
+		{"Example.com.", "example.com", true},
+		{"pr-1-web.notexample.com", "example.com", false},
+		{"example.com", "dev.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := domainInZone(tt.domain, tt.zone); got != tt.want {
+			t.Errorf("domainInZone(%q, %q) = %v, want %v", tt.domain, tt.zone, got, tt.want)
+		}
+	}
+}
+
+func TestMatchingZones(t *testing.T) {
+	zone := func(id string, private bool) r53types.HostedZone {
+		return r53types.HostedZone{
+			Id:     aws.String("/hostedzone/" + id),
+			Name:   aws.String("example.com."),
+			Config: &r53types.HostedZoneConfig{PrivateZone: private},
+		}
+	}
+	noConfig := r53types.HostedZone{Id: aws.String("/hostedzone/ZNOCONFIG"), Name: aws.String("example.com.")}
+
+	tests := []struct {
+		name    string
+		zones   []r53types.HostedZone
+		private bool
+		want    []string
+	}{
+		{"none", nil, false, nil},
+		{"public only", []r53types.HostedZone{zone("ZPUB", false), zone("ZPRIV", true)}, false, []string{"ZPUB"}},
+		{"private only", []r53types.HostedZone{zone("ZPUB", false), zone("ZPRIV", true)}, true, []string{"ZPRIV"}},
+		{"no config is public", []r53types.HostedZone{noConfig}, false, []string{"ZNOCONFIG"}},
+		{"ambiguous", []r53types.HostedZone{zone("ZA", false), zone("ZB", false)}, false, []string{"ZA", "ZB"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchingZones(tt.zones, tt.private); !slices.Equal(got, tt.want) {
+				t.Errorf("matchingZones() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
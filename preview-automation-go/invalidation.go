@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// syncResult records what a sync changed in the bucket.
+type syncResult struct {
+	Uploaded  []string `json:"uploaded,omitempty"`
+	Updated   []string `json:"updated,omitempty"` // headers only
+	Deleted   []string `json:"deleted,omitempty"`
+	Unchanged int      `json:"unchanged"`
+}
+
+func (r *syncResult) changedKeys() []string {
+	return slices.Concat(r.Uploaded, r.Updated, r.Deleted)
+}
+
+// listObjectETags returns the ETag of every object in the preview bucket.
+func (pm *PreviewManager) listObjectETags(ctx context.Context) (map[string]string, error) {
+	etags := make(map[string]string)
+
+	paginator := s3.NewListObjectsV2Paginator(pm.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(pm.bucketName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			etags[aws.ToString(obj.Key)] = strings.Trim(aws.ToString(obj.ETag), `"`)
+		}
+	}
+
+	return etags, nil
+}
+
+// deleteObjects deletes keys from the preview bucket in batches of 1000.
+func (pm *PreviewManager) deleteObjects(ctx context.Context, keys []string) error {
+	for start := 0; start < len(keys); start += 1000 {
+		end := min(start+1000, len(keys))
+
+		var objects []s3types.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		_, err := pm.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(pm.bucketName),
+			Delete: &s3types.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+	}
+	return nil
+}
+
+// invalidationPaths turns changed object keys into CloudFront paths. Index
+// documents also invalidate their directory, and "/" is always included.
+// Above maxPaths, paths are collapsed into one wildcard per top-level
+// directory, and into "/*" if that is still too many.
+func invalidationPaths(keys []string, maxPaths int) []string {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	set := map[string]struct{}{"/": {}}
+	for _, key := range keys {
+		set["/"+key] = struct{}{}
+		if path.Base(key) == "index.html" {
+			if dir := path.Dir(key); dir != "." {
+				set["/"+dir] = struct{}{}
+				set["/"+dir+"/"] = struct{}{}
+			}
+		}
+	}
+	if len(set) <= maxPaths {
+		return sortedKeys(set)
+	}
+
+	collapsed := make(map[string]struct{})
+	for p := range set {
+		if top, _, nested := strings.Cut(strings.TrimPrefix(p, "/"), "/"); nested {
+			collapsed["/"+top+"/*"] = struct{}{}
+		} else {
+			collapsed[p] = struct{}{}
+		}
+	}
+	if len(collapsed) <= maxPaths {
+		return sortedKeys(collapsed)
+	}
+
+	return []string{"/*"}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printDeploySummary prints what the deploy changed.
+func (pm *PreviewManager) printDeploySummary(journal *deployJournal) error {
+	files := "-"
+	if journal.Sync != nil {
+		files = fmt.Sprintf("%d uploaded, %d headers updated, %d deleted, %d unchanged", len(journal.Sync.Uploaded), len(journal.Sync.Updated), len(journal.Sync.Deleted), journal.Sync.Unchanged)
+	}
+
+	invalidation := journal.InvalidationNote
+	if len(journal.InvalidationPaths) > 0 {
+		invalidation = fmt.Sprintf("%s (%s)", strings.Join(journal.InvalidationPaths, ", "), journal.InvalidationID)
+	}
+
+	fmt.Fprintln(pm.out, "\nDeploy summary:")
+	w := newTableWriter(pm.out)
+	if pm.built != nil {
+		fmt.Fprintf(w, "  Build:\t%s\n", pm.built)
+		fmt.Fprintf(w, "  Build log:\t%s\n", orDash(pm.built.Log))
+	}
+	fmt.Fprintf(w, "  Files:\t%s\n", files)
+	fmt.Fprintf(w, "  Invalidation:\t%s\n", orDash(invalidation))
+	return w.Flush()
+}
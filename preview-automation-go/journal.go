@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Resources a deploy can create, in creation order.
+const (
+	resourceBucket       = "bucket"
+	resourceOAC          = "oac"
+	resourceDistribution = "distribution"
+	resourceDNS          = "dns"
+)
+
+// deployJournal records the progress of a deploy so a retried run can resume
+// at the stage that failed, and so a failed deploy knows what it created.
+type deployJournal struct {
+	RunID       string            `json:"runId"`
+	SHA         string            `json:"sha,omitempty"`
+	StartedAt   time.Time         `json:"startedAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	Completed   bool              `json:"completed"`
+	NewPreview  bool              `json:"newPreview"`
+	FailedStage string            `json:"failedStage,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Stages      []journalStage    `json:"stages"`
+	Created     map[string]string `json:"created,omitempty"`
+
+	Sync              *syncResult `json:"sync,omitempty"`
+	InvalidationPaths []string    `json:"invalidationPaths,omitempty"`
+	InvalidationNote  string      `json:"invalidationNote,omitempty"`
+
+	// PendingInvalidation holds the keys earlier failed deploys changed but
+	// did not invalidate. InvalidateAll is set when they cannot be known.
+	PendingInvalidation []string `json:"pendingInvalidation,omitempty"`
+	InvalidateAll       bool     `json:"invalidateAll,omitempty"`
+
+	OACID           string     `json:"oacId,omitempty"`
+	FunctionARN     string     `json:"functionArn,omitempty"`
+	WebACLARN       string     `json:"webAclArn,omitempty"`
+	HeadersPolicyID string     `json:"headersPolicyId,omitempty"`
+	DistributionID  string     `json:"distributionId,omitempty"`
+	InvalidationID  string     `json:"invalidationId,omitempty"`
+	ChangeID        string     `json:"changeId,omitempty"`
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`
+}
+
+// journalStage is a completed deploy stage and the run that completed it.
+type journalStage struct {
+	Name        string    `json:"name"`
+	RunID       string    `json:"runId"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+func (j *deployJournal) done(stage string) (journalStage, bool) {
+	for _, s := range j.Stages {
+		if s.Name == stage {
+			return s, true
+		}
+	}
+	return journalStage{}, false
+}
+
+func (j *deployJournal) complete(stage string) {
+	j.Stages = append(j.Stages, journalStage{Name: stage, RunID: j.RunID, CompletedAt: time.Now().UTC()})
+}
+
+func (j *deployJournal) created(resource, id string) {
+	if j.Created == nil {
+		j.Created = make(map[string]string)
+	}
+	j.Created[resource] = id
+}
+
+// uninvalidated returns the keys the deploy and the deploys it carried over
+// changed, unless it got as far as invalidating them.
+func (j *deployJournal) uninvalidated() []string {
+	if _, ok := j.done("invalidation"); ok {
+		return nil
+	}
+	keys := slices.Clone(j.PendingInvalidation)
+	if j.Sync != nil {
+		keys = append(keys, j.Sync.changedKeys()...)
+	}
+	return keys
+}
+
+// leftBehind describes the resources the journal created, for error reports.
+func (j *deployJournal) leftBehind() []string {
+	var resources []string
+	for _, resource := range []string{resourceBucket, resourceOAC, resourceDistribution, resourceDNS} {
+		if id, ok := j.Created[resource]; ok {
+			resources = append(resources, fmt.Sprintf("%s %s", resource, id))
+		}
+	}
+	return resources
+}
+
+// stageError reports the deploy stage that failed and what it left behind.
+type stageError struct {
+	Stage      string
+	Err        error
+	LeftBehind []string
+	RolledBack bool
+}
+
+func (e *stageError) Error() string {
+	msg := fmt.Sprintf("stage %q failed: %v", e.Stage, e.Err)
+	switch {
+	case e.RolledBack:
+		msg += "; resources created by this deploy were rolled back"
+	case len(e.LeftBehind) > 0:
+		msg += fmt.Sprintf("; left behind: %s (rerun to resume)", strings.Join(e.LeftBehind, ", "))
+	}
+	return msg
+}
+
+func (e *stageError) Unwrap() error {
+	return e.Err
+}
+
+// journalStore keeps the journal of the latest deploy of each preview.
+type journalStore interface {
+	// GetJournal returns nil without an error when there is no journal.
+	GetJournal(ctx context.Context, key previewKey) (*deployJournal, error)
+	PutJournal(ctx context.Context, key previewKey, journal *deployJournal) error
+	DeleteJournal(ctx context.Context, key previewKey) error
+}
+
+func (r *s3Registry) journalKey(key previewKey) string {
+	return "journals/" + registryID(r.repo, key) + ".json"
+}
+
+func (r *s3Registry) GetJournal(ctx context.Context, key previewKey) (*deployJournal, error) {
+	result, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.journalKey(key)),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read deploy journal: %w", err)
+	}
+	defer result.Body.Close()
+
+	var journal deployJournal
+	if err := json.NewDecoder(result.Body).Decode(&journal); err != nil {
+		return nil, fmt.Errorf("failed to decode deploy journal: %w", err)
+	}
+	return &journal, nil
+}
+
+func (r *s3Registry) PutJournal(ctx context.Context, key previewKey, journal *deployJournal) error {
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucket),
+		Key:         aws.String(r.journalKey(key)),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write deploy journal: %w", err)
+	}
+	return nil
+}
+
+func (r *s3Registry) DeleteJournal(ctx context.Context, key previewKey) error {
+	_, err := r.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.journalKey(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete deploy journal: %w", err)
+	}
+	return nil
+}
+
+func (r *dynamoRegistry) journalItemKey(key previewKey) map[string]ddbtypes.AttributeValue {
+	return map[string]ddbtypes.AttributeValue{
+		"id": &ddbtypes.AttributeValueMemberS{Value: "journal:" + registryID(r.repo, key)},
+	}
+}
+
+func (r *dynamoRegistry) GetJournal(ctx context.Context, key previewKey) (*deployJournal, error) {
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(r.table),
+		Key:            r.journalItemKey(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deploy journal: %w", err)
+	}
+
+	attr, ok := result.Item["journal"].(*ddbtypes.AttributeValueMemberS)
+	if !ok {
+		return nil, nil
+	}
+
+	var journal deployJournal
+	if err := json.Unmarshal([]byte(attr.Value), &journal); err != nil {
+		return nil, fmt.Errorf("failed to decode deploy journal: %w", err)
+	}
+	return &journal, nil
+}
+
+func (r *dynamoRegistry) PutJournal(ctx context.Context, key previewKey, journal *deployJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	item := r.journalItemKey(key)
+	item["journal"] = &ddbtypes.AttributeValueMemberS{Value: string(data)}
+
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.table),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write deploy journal: %w", err)
+	}
+	return nil
+}
+
+func (r *dynamoRegistry) DeleteJournal(ctx context.Context, key previewKey) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.table),
+		Key:       r.journalItemKey(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete deploy journal: %w", err)
+	}
+	return nil
+}
+
+// startJournal resumes the journal of a failed deploy of the same commit, or
+// starts a new one that carries over the changes the failed deploy did not
+// invalidate. Without a state backend the journal only lives for this run,
+// and since an earlier run may have failed unnoticed, everything is
+// invalidated.
+func (pm *PreviewManager) startJournal(ctx context.Context) (*deployJournal, error) {
+	now := time.Now().UTC()
+	fresh := &deployJournal{
+		RunID:     lockOwner(),
+		SHA:       pm.cfg.SHA,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+
+	if pm.journals == nil {
+		fresh.InvalidateAll = true
+		return fresh, nil
+	}
+
+	previous, err := pm.journals.GetJournal(ctx, previewKey{PRNumber: pm.cfg.PRNumber, AppName: pm.cfg.AppName})
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil || previous.Completed {
+		return fresh, nil
+	}
+	if previous.FailedStage == "" {
+		// The run was killed before it could record the failure.
+		fmt.Fprintf(pm.out, "  Previous deploy of %s did not finish, starting over for %s\n", shortSHA(previous.SHA), shortSHA(pm.cfg.SHA))
+		fresh.InvalidateAll = true
+		return fresh, nil
+	}
+	if pm.cfg.SHA == "" || previous.SHA != pm.cfg.SHA {
+		fmt.Fprintf(pm.out, "  Previous deploy of %s failed at %q, starting over for %s\n", shortSHA(previous.SHA), previous.FailedStage, shortSHA(pm.cfg.SHA))
+		fresh.NewPreview = previous.NewPreview
+		fresh.Created = previous.Created
+		fresh.PendingInvalidation = previous.uninvalidated()
+		_, invalidated := previous.done("invalidation")
+		fresh.InvalidateAll = previous.InvalidateAll && !invalidated
+		return fresh, nil
+	}
+
+	fmt.Fprintf(pm.out, "  Resuming deploy of %s at stage %q (failed in run %s)\n", shortSHA(previous.SHA), previous.FailedStage, previous.RunID)
+	previous.RunID = fresh.RunID
+	previous.FailedStage = ""
+	previous.Error = ""
+	if previous.ExpiresAt != nil {
+		pm.expiresAt = *previous.ExpiresAt
+	}
+	return previous, nil
+}
+
+func (pm *PreviewManager) saveJournal(ctx context.Context, journal *deployJournal) {
+	if pm.journals == nil {
+		return
+	}
+
+	journal.UpdatedAt = time.Now().UTC()
+	err := pm.journals.PutJournal(ctx, previewKey{PRNumber: pm.cfg.PRNumber, AppName: pm.cfg.AppName}, journal)
+	if err != nil {
+		fmt.Fprintf(pm.out, "  Warning: %v\n", err)
+	}
+}
+
+func (pm *PreviewManager) deleteJournal(ctx context.Context) error {
+	if pm.journals == nil {
+		return nil
+	}
+	return pm.journals.DeleteJournal(ctx, previewKey{PRNumber: pm.cfg.PRNumber, AppName: pm.cfg.AppName})
+}
+
+// failDeploy records the failed stage and, with --rollback-on-failure, removes
+// what the deploy created if the preview did not exist before it.
+func (pm *PreviewManager) failDeploy(ctx context.Context, journal *deployJournal, stage string, err error) error {
+	journal.FailedStage = stage
+	journal.Error = err.Error()
+
+	stageErr := &stageError{Stage: stage, Err: err, LeftBehind: journal.leftBehind()}
+	fmt.Fprintf(pm.out, "Deploy failed at stage %q: %v\n", stage, err)
+
+	if !pm.cfg.RollbackOnFailure || len(journal.Created) == 0 {
+		pm.saveJournal(ctx, journal)
+		return stageErr
+	}
+	if !journal.NewPreview {
+		fmt.Fprintln(pm.out, "  Not rolling back: the preview existed before this deploy")
+		pm.saveJournal(ctx, journal)
+		return stageErr
+	}
+
+	// Rollback must run even if the deploy was cancelled.
+	ctx = context.WithoutCancel(ctx)
+	if rollbackErr := pm.rollback(ctx, journal); rollbackErr != nil {
+		fmt.Fprintf(pm.out, "  Warning: rollback incomplete: %v\n", rollbackErr)
+		stageErr.LeftBehind = journal.leftBehind()
+		pm.saveJournal(ctx, journal)
+		return stageErr
+	}
+
+	stageErr.RolledBack = true
+	if err := pm.deleteJournal(ctx); err != nil {
+		fmt.Fprintf(pm.out, "  Warning: %v\n", err)
+	}
+	return stageErr
+}
+
+// rollback removes the resources recorded as created in the journal, newest
+// first, dropping each from the journal once it is gone.
+func (pm *PreviewManager) rollback(ctx context.Context, journal *deployJournal) error {
+	fmt.Fprintln(pm.out, "Rolling back resources created by this deploy...")
+
+	if _, ok := journal.Created[resourceDNS]; ok {
+		if err := pm.deleteRoute53Records(ctx); err != nil {
+			return err
+		}
+		delete(journal.Created, resourceDNS)
+	}
+
+	pendingDeletion := false
+	if distributionID, ok := journal.Created[resourceDistribution]; ok {
+		if err := pm.deleteCloudFrontDistribution(ctx, distributionID); err != nil {
+			return err
+		}
+		pendingDeletion = pm.cfg.AsyncDelete
+		delete(journal.Created, resourceDistribution)
+	}
+
+	if _, ok := journal.Created[resourceBucket]; ok {
+		if err := pm.deleteS3Bucket(ctx); err != nil {
+			return err
+		}
+		delete(journal.Created, resourceBucket)
+	}
+
+	// Like cleanup, an OAC still attached to a disabled distribution is left
+	// for gc.
+	if _, ok := journal.Created[resourceOAC]; ok && !pendingDeletion {
+		if err := pm.deleteOriginAccessControl(ctx); err != nil {
+			return err
+		}
+		delete(journal.Created, resourceOAC)
+	}
+
+	err := pm.updateRecord(ctx, func(r *previewRecord) {
+		if pendingDeletion {
+			r.Status = recordDeleting
+			r.DistributionID = journal.DistributionID
+			return
+		}
+		now := time.Now().UTC()
+		r.Status = recordDeleted
+		r.DeletedAt = &now
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update preview registry: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ Rolled back")
+	return nil
+}
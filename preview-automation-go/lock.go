@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// errSuperseded is returned by a deploy whose commit is no longer the PR head.
+var errSuperseded = errors.New("deploy superseded by a newer commit")
+
+// lockInfo is stored in the lock so waiting runs can report who holds it.
+type lockInfo struct {
+	Owner      string    `json:"owner"`
+	Action     string    `json:"action"`
+	SHA        string    `json:"sha,omitempty"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// lockBackend implements a lease on a single lock ID. Leases that are not
+// renewed before they expire can be taken over by another owner.
+type lockBackend interface {
+	// tryAcquire takes the lock if it is free or expired. When it is held
+	// by someone else the current holder is returned.
+	tryAcquire(ctx context.Context, id string, info lockInfo) (bool, *lockInfo, error)
+	renew(ctx context.Context, id string, info lockInfo) error
+	release(ctx context.Context, id string, info lockInfo) error
+}
+
+// s3LockBackend stores locks as objects in the state bucket and relies on
+// S3 conditional writes so only one writer wins.
+type s3LockBackend struct {
+	client *s3.Client
+	bucket string
+	etags  map[string]string
+	out    io.Writer
+}
+
+func (b *s3LockBackend) key(id string) string {
+	return "locks/" + id + ".json"
+}
+
+func (b *s3LockBackend) put(ctx context.Context, id string, info lockInfo, ifMatch, ifNoneMatch *string) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	result, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(b.key(id)),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+		IfMatch:     ifMatch,
+		IfNoneMatch: ifNoneMatch,
+	})
+	if err != nil {
+		return err
+	}
+
+	b.etags[id] = aws.ToString(result.ETag)
+	return nil
+}
+
+func (b *s3LockBackend) tryAcquire(ctx context.Context, id string, info lockInfo) (bool, *lockInfo, error) {
+	err := b.put(ctx, id, info, nil, aws.String("*"))
+	if err == nil {
+		return true, nil, nil
+	}
+	if !isConditionFailure(err) {
+		return false, nil, fmt.Errorf("failed to write lock: %w", err)
+	}
+
+	result, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(id)),
+	})
+	if err != nil {
+		// The holder may have released the lock in the meantime.
+		return false, nil, nil
+	}
+	defer result.Body.Close()
+
+	var holder lockInfo
+	if err := json.NewDecoder(result.Body).Decode(&holder); err != nil {
+		return false, nil, fmt.Errorf("failed to decode lock: %w", err)
+	}
+
+	if time.Now().Before(holder.ExpiresAt) {
+		return false, &holder, nil
+	}
+
+	// Only the run that saw this exact stale version gets to replace it.
+	err = b.put(ctx, id, info, result.ETag, nil)
+	if err == nil {
+		fmt.Fprintf(b.out, "  Took over stale lock held by %s (%s, expired %s)\n", holder.Owner, holder.Action, holder.ExpiresAt.Format(time.RFC3339))
+		return true, nil, nil
+	}
+	if isConditionFailure(err) {
+		return false, &holder, nil
+	}
+	return false, nil, fmt.Errorf("failed to take over lock: %w", err)
+}
+
+func (b *s3LockBackend) renew(ctx context.Context, id string, info lockInfo) error {
+	if err := b.put(ctx, id, info, aws.String(b.etags[id]), nil); err != nil {
+		return fmt.Errorf("failed to renew lock: %w", err)
+	}
+	return nil
+}
+
+func (b *s3LockBackend) release(ctx context.Context, id string, info lockInfo) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(b.bucket),
+		Key:     aws.String(b.key(id)),
+		IfMatch: aws.String(b.etags[id]),
+	})
+	if err != nil && !isConditionFailure(err) {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	return nil
+}
+
+// dynamoLockBackend stores locks as items in the registry table, next to the
+// preview records.
+type dynamoLockBackend struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (b *dynamoLockBackend) itemID(id string) string {
+	return "lock:" + id
+}
+
+func (b *dynamoLockBackend) tryAcquire(ctx context.Context, id string, info lockInfo) (bool, *lockInfo, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return false, nil, err
+	}
+
+	_, err = b.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(b.table),
+		Item: map[string]ddbtypes.AttributeValue{
+			"id":        &ddbtypes.AttributeValueMemberS{Value: b.itemID(id)},
+			"owner":     &ddbtypes.AttributeValueMemberS{Value: info.Owner},
+			"expiresAt": &ddbtypes.AttributeValueMemberN{Value: strconv.FormatInt(info.ExpiresAt.Unix(), 10)},
+			"lock":      &ddbtypes.AttributeValueMemberS{Value: string(data)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id) OR expiresAt < :now OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":now":   &ddbtypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+			":owner": &ddbtypes.AttributeValueMemberS{Value: info.Owner},
+		},
+	})
+	if err == nil {
+		return true, nil, nil
+	}
+
+	var conditionFailed *ddbtypes.ConditionalCheckFailedException
+	if !errors.As(err, &conditionFailed) {
+		return false, nil, fmt.Errorf("failed to write lock: %w", err)
+	}
+
+	result, err := b.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(b.table),
+		Key: map[string]ddbtypes.AttributeValue{
+			"id": &ddbtypes.AttributeValueMemberS{Value: b.itemID(id)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to read lock: %w", err)
+	}
+
+	attr, ok := result.Item["lock"].(*ddbtypes.AttributeValueMemberS)
+	if !ok {
+		return false, nil, nil
+	}
+
+	var holder lockInfo
+	if err := json.Unmarshal([]byte(attr.Value), &holder); err != nil {
+		return false, nil, fmt.Errorf("failed to decode lock: %w", err)
+	}
+	return false, &holder, nil
+}
+
+func (b *dynamoLockBackend) renew(ctx context.Context, id string, info lockInfo) error {
+	acquired, holder, err := b.tryAcquire(ctx, id, info)
+	if err != nil {
+		return fmt.Errorf("failed to renew lock: %w", err)
+	}
+	if !acquired {
+		return fmt.Errorf("lock was taken over by %s", holder.Owner)
+	}
+	return nil
+}
+
+func (b *dynamoLockBackend) release(ctx context.Context, id string, info lockInfo) error {
+	_, err := b.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(b.table),
+		Key: map[string]ddbtypes.AttributeValue{
+			"id": &ddbtypes.AttributeValueMemberS{Value: b.itemID(id)},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":owner": &ddbtypes.AttributeValueMemberS{Value: info.Owner},
+		},
+	})
+	var conditionFailed *ddbtypes.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionFailed) {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	return nil
+}
+
+func isConditionFailure(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
+}
+
+// lockOwner identifies this run in the lock, preferring the Actions run.
+func lockOwner() string {
+	if runID := os.Getenv("GITHUB_RUN_ID"); runID != "" {
+		return fmt.Sprintf("github-run-%s-%s", runID, os.Getenv("GITHUB_RUN_ATTEMPT"))
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// withLock runs fn while holding the preview lock, renewing the lease in the
+// background. While waiting for the lock, abort is called on every attempt
+// and once more after acquiring it; an error from abort ends the wait.
+// If renewing the lease fails, e.g. because another run took the lock over,
+// fn's context is canceled and withLock returns the renew error.
+// Without a state backend fn runs unlocked.
+func (pm *PreviewManager) withLock(ctx context.Context, abort func(context.Context) error, fn func(context.Context) error) error {
+	if abort == nil {
+		abort = func(context.Context) error { return nil }
+	}
+
+	if pm.locks == nil {
+		if err := abort(ctx); err != nil {
+			return err
+		}
+		return fn(ctx)
+	}
+
+	id := registryID(pm.repo(), previewKey{PRNumber: pm.cfg.PRNumber, AppName: pm.cfg.AppName})
+	info := lockInfo{
+		Owner:  lockOwner(),
+		Action: pm.cfg.Action,
+		SHA:    pm.cfg.SHA,
+	}
+
+	fmt.Fprintf(pm.out, "Acquiring lock for %s...\n", pm.bucketName)
+	deadline := time.Now().Add(pm.cfg.LockTimeout)
+	for {
+		if err := abort(ctx); err != nil {
+			return err
+		}
+
+		info.AcquiredAt = time.Now().UTC()
+		info.ExpiresAt = info.AcquiredAt.Add(pm.cfg.LockTTL)
+		acquired, holder, err := pm.locks.tryAcquire(ctx, id, info)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			if holder != nil {
+				return fmt.Errorf("preview is locked by %s (%s since %s), gave up after %s",
+					holder.Owner, holder.Action, holder.AcquiredAt.Format(time.RFC3339), pm.cfg.LockTimeout)
+			}
+			return fmt.Errorf("failed to acquire lock within %s", pm.cfg.LockTimeout)
+		}
+
+		if holder != nil {
+			fmt.Fprintf(pm.out, "  Lock held by %s (%s %s since %s), waiting...\n",
+				holder.Owner, holder.Action, shortSHA(holder.SHA), holder.AcquiredAt.Format(time.RFC3339))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	fmt.Fprintf(pm.out, "  ✓ Lock acquired (%s)\n", info.Owner)
+
+	lockCtx, cancelLock := context.WithCancelCause(ctx)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		ticker := time.NewTicker(pm.cfg.LockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+				info.ExpiresAt = time.Now().UTC().Add(pm.cfg.LockTTL)
+				if err := pm.locks.renew(lockCtx, id, info); err != nil && lockCtx.Err() == nil {
+					cancelLock(fmt.Errorf("lost the preview lock: %w", err))
+					return
+				}
+			}
+		}
+	}()
+
+	defer func() {
+		cancelLock(nil)
+		<-heartbeatDone
+		if err := pm.locks.release(context.WithoutCancel(ctx), id, info); err != nil {
+			fmt.Fprintf(pm.out, "Warning: %v\n", err)
+		} else {
+			fmt.Fprintln(pm.out, "  ✓ Lock released")
+		}
+	}()
+
+	err := abort(lockCtx)
+	if err == nil {
+		err = fn(lockCtx)
+	}
+	if ctx.Err() == nil && lockCtx.Err() != nil {
+		return context.Cause(lockCtx)
+	}
+	return err
+}
+
+// checkSuperseded returns errSuperseded when the PR head has moved past the
+// commit being deployed, so an older run does not overwrite a newer one.
+func (pm *PreviewManager) checkSuperseded(ctx context.Context) error {
+	if pm.cfg.SHA == "" || pm.githubClient == nil {
+		return nil
+	}
+
+	pr, _, err := pm.githubClient.PullRequests.Get(ctx, pm.cfg.RepoOwner, pm.cfg.RepoName, pm.cfg.PRNumber)
+	if err != nil {
+		fmt.Fprintf(pm.out, "  Warning: failed to check PR head: %v\n", err)
+		return nil
+	}
+
+	if head := pr.GetHead().GetSHA(); head != "" && head != pm.cfg.SHA {
+		fmt.Fprintf(pm.out, "  PR head is now %s, skipping deploy of %s\n", shortSHA(head), shortSHA(pm.cfg.SHA))
+		return errSuperseded
+	}
+	return nil
+}
@@ -2,32 +2,107 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/route53"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
 	"github.com/google/go-github/v66/github"
 	"golang.org/x/oauth2"
 )
 
 type Config struct {
+	ConfigPath     string
 	PRNumber       int
 	AppName        string
+	AppPaths       stringList
+	SharedPaths    stringList
+	BaseSHA        string
 	Region         string
 	BaseDomain     string
 	CertificateARN string
+	HostedZoneID   string
+	PrivateZone    bool
 	SourcePath     string
-	Action         string // "deploy" or "cleanup"
+	Routing        string
+	Auth           string
+	AuthSecret     string
+	Action         string // "deploy", "plan", "cleanup", "extend", "sleep", "wake", "status", "list", "gc" or "doctor"
 	RepoOwner      string
 	RepoName       string
+
+	AllowCIDRs stringList
+	WAFName    string
+
+	SecurityHeaders bool
+	Noindex         bool
+	CSP             string
+	ResponseHeaders stringList
+
+	KMSKeyID string
+
+	BuildCommand string
+	BuildDir     string
+	BuildEnv     stringList
+	BuildCache   bool
+
+	CacheRules      stringList
+	DeployedComment string
+	CleanupComment  string
+
+	Scan                  bool
+	ScanAllowPaths        stringList
+	ScanAllowFingerprints stringList
+	ScanKey               string
+
+	Wait                bool
+	DNSTimeout          time.Duration
+	DeployTimeout       time.Duration
+	InvalidationTimeout time.Duration
+
+	InvalidationMaxPaths int
+
+	Verify         bool
+	VerifyPaths    stringList
+	VerifyHeaders  stringList
+	VerifyAttempts int
+
+	AsyncDelete     bool
+	MaxAge          time.Duration
+	DryRun          bool
+	CollectUntagged bool
+	TTL             time.Duration
+
+	StateBucket   string
+	RegistryTable string
+	SHA           string
+	All           bool
+
+	LockTTL     time.Duration
+	LockTimeout time.Duration
+
+	RollbackOnFailure bool
+
+	MaxAttempts int
+	MaxBackoff  time.Duration
 }
 
 type PreviewManager struct {
@@ -35,43 +110,63 @@ type PreviewManager struct {
 	awsCfg       aws.Config
 	s3Client     *s3.Client
 	cfClient     *cloudfront.Client
+	smClient     *secretsmanager.Client
+	wafClient    *wafv2.Client
+	kmsClient    *kms.Client
 	r53Client    *route53.Client
 	githubClient *github.Client
 	bucketName   string
 	fullDomain   string
 	subdomain    string
+	hostedZoneID string
+	expiresAt    time.Time
+	registry     previewRegistry
+	locks        lockBackend
+	journals     journalStore
+	deployRef    string
+	auth         *previewAuth
+	built        *buildResult
+	// buildMu is shared by the apps of a multi-app run that build in the
+	// same directory, so they do not install dependencies concurrently.
+	buildMu *sync.Mutex
+	// summarized is set on the apps of a multi-app run, whose deploy and
+	// cleanup comments are replaced by one comment for all apps.
+	summarized bool
+	// out receives the progress output, prefixed with the app name when
+	// several apps run in parallel.
+	out io.Writer
 }
 
 func main() {
-	cfg := &Config{}
-
-	flag.IntVar(&cfg.PRNumber, "pr", 0, "Pull Request number")
-	flag.StringVar(&cfg.AppName, "app", "", "Application name")
-	flag.StringVar(&cfg.Region, "region", "us-east-1", "AWS region")
-	flag.StringVar(&cfg.BaseDomain, "domain", "", "Base domain (e.g., preview.yourapp.com)")
-	flag.StringVar(&cfg.CertificateARN, "cert", "", "ACM Certificate ARN")
-	flag.StringVar(&cfg.SourcePath, "source", "./dist", "Source directory to upload")
-	flag.StringVar(&cfg.Action, "action", "deploy", "Action to perform: deploy or cleanup")
-	flag.StringVar(&cfg.RepoOwner, "repo-owner", "", "GitHub repository owner")
-	flag.StringVar(&cfg.RepoName, "repo-name", "", "GitHub repository name")
-	flag.Parse()
-
-	if cfg.PRNumber == 0 {
-		log.Fatal("PR number is required (--pr)")
-	}
-	if cfg.AppName == "" {
-		log.Fatal("App name is required (--app)")
-	}
-	if cfg.BaseDomain == "" {
-		log.Fatal("Base domain is required (--domain)")
+	cfg, file, err := parseConfig(os.Args[1:], "")
+	if err != nil {
+		log.Fatal(err)
 	}
-	if cfg.RepoOwner == "" {
-		log.Fatal("Repository owner is required (--repo-owner)")
+
+	// Without --app, actions on a preview run for every app of the config
+	// file when it defines several.
+	var apps []*Config
+	if cfg.AppName == "" && file != nil && len(file.Apps) > 1 && perAppActions[cfg.Action] {
+		for _, name := range file.appNames() {
+			appCfg, _, err := parseConfig(os.Args[1:], name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := validateConfig(appCfg); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			apps = append(apps, appCfg)
+		}
+	} else if err := validateConfig(cfg); err != nil {
+		log.Fatal(err)
 	}
 
 	ctx := context.Background()
 
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.Region))
+	awsCfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(cfg.Region),
+		config.WithRetryer(newRetryer(cfg)),
+	)
 	if err != nil {
 		log.Fatalf("Unable to load AWS config: %v", err)
 	}
@@ -87,33 +182,386 @@ func main() {
 		log.Println("Warning: GITHUB_TOKEN not set, PR comment will be skipped")
 	}
 
-	bucketName := fmt.Sprintf("pr-%d-%s", cfg.PRNumber, cfg.AppName)
+	pm := newPreviewManager(cfg, awsCfg, githubClient, os.Stdout)
+
+	if apps != nil {
+		if err := pm.RunApps(ctx, apps); err != nil {
+			log.Fatalf("%s failed: %v", cfg.Action, err)
+		}
+		return
+	}
+
+	switch cfg.Action {
+	case "cleanup":
+		err := pm.withLock(ctx, nil, pm.Cleanup)
+		if errors.Is(err, errNoPreview) {
+			fmt.Println("Cleanup skipped: the preview was never deployed")
+			return
+		}
+		if err != nil {
+			log.Fatalf("Cleanup failed: %v", err)
+		}
+		fmt.Println("Cleanup completed successfully")
+	case "extend":
+		if err := pm.withLock(ctx, nil, pm.Extend); err != nil {
+			log.Fatalf("Extend failed: %v", err)
+		}
+	case "sleep":
+		if err := pm.withLock(ctx, nil, pm.Sleep); err != nil {
+			log.Fatalf("Sleep failed: %v", err)
+		}
+	case "wake":
+		if err := pm.withLock(ctx, nil, pm.Wake); err != nil {
+			log.Fatalf("Wake failed: %v", err)
+		}
+	case "status":
+		if err := pm.Status(ctx); err != nil {
+			log.Fatalf("Status failed: %v", err)
+		}
+	case "list":
+		if err := pm.List(ctx); err != nil {
+			log.Fatalf("List failed: %v", err)
+		}
+	case "gc":
+		if err := pm.GarbageCollect(ctx); err != nil {
+			log.Fatalf("Garbage collection failed: %v", err)
+		}
+		fmt.Println("Garbage collection completed successfully")
+	case "plan":
+		if pm.unchanged(ctx) {
+			fmt.Println("Plan: the deploy would be skipped, the PR does not change this app")
+			return
+		}
+		if err := pm.Plan(ctx); err != nil {
+			log.Fatalf("Plan failed: %v", err)
+		}
+	case "doctor":
+		if err := pm.Doctor(ctx); err != nil {
+			log.Fatalf("Doctor failed: %v", err)
+		}
+	default:
+		if pm.unchanged(ctx) {
+			if err := pm.withLock(ctx, nil, pm.keepAlive); err != nil {
+				log.Fatalf("Deployment failed: %v", err)
+			}
+			fmt.Println("Deployment skipped: the PR does not change this app")
+			return
+		}
+		err := pm.withLock(ctx, pm.checkSuperseded, pm.Deploy)
+		if errors.Is(err, errSuperseded) {
+			fmt.Println("Deployment skipped: a newer commit will be deployed by another run")
+			return
+		}
+		if err != nil {
+			log.Fatalf("Deployment failed: %v", err)
+		}
+		fmt.Printf("\n✓ Preview environment deployed successfully!\n")
+		fmt.Printf("URL: https://%s\n", pm.fullDomain)
+		if !cfg.Wait {
+			fmt.Printf("Note: Initial deployment may take 3-5 minutes for CloudFront to propagate globally.\n")
+		}
+	}
+}
+
+// parseConfig parses the flags in args, with appName as --app when not
+// empty, and fills the flags not given from the environment and the config
+// file. It returns the config file too, nil without --config.
+func parseConfig(args []string, appName string) (*Config, *fileConfig, error) {
+	cfg := &Config{}
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	defineFlags(flags, cfg)
+	_ = flags.Parse(args)
 
-	pm := &PreviewManager{
+	if appName != "" {
+		if err := flags.Set("app", appName); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	file, err := loadSettings(flags, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, file, nil
+}
+
+func defineFlags(flags *flag.FlagSet, cfg *Config) {
+	flags.StringVar(&cfg.ConfigPath, "config", "", "preview.yaml config file; flags and PR_PREVIEW_* environment variables override its settings")
+	flags.IntVar(&cfg.PRNumber, "pr", 0, "Pull Request number")
+	flags.StringVar(&cfg.AppName, "app", "", "Application name (default every app of --config)")
+	flags.Var(&cfg.AppPaths, "app-path", "Glob of the repository files of the app; deploys skip apps whose files the PR does not change (repeatable)")
+	flags.Var(&cfg.SharedPaths, "shared-path", "Glob of repository files every app depends on, e.g. a lockfile (repeatable)")
+	flags.StringVar(&cfg.BaseSHA, "base-sha", "", "PR base commit; deploys diff it against --sha to skip the apps the PR does not change")
+	flags.StringVar(&cfg.Region, "region", "us-east-1", "AWS region")
+	flags.StringVar(&cfg.BaseDomain, "domain", "", "Base domain (e.g., preview.yourapp.com)")
+	flags.StringVar(&cfg.CertificateARN, "cert", "", "ACM Certificate ARN")
+	flags.StringVar(&cfg.HostedZoneID, "hosted-zone-id", "", "Route53 hosted zone ID (skips zone lookup by name)")
+	flags.BoolVar(&cfg.PrivateZone, "private-zone", false, "Look up a private hosted zone instead of a public one")
+	flags.StringVar(&cfg.SourcePath, "source", "./dist", "Source directory to upload")
+	flags.StringVar(&cfg.BuildCommand, "build-command", "", "Shell command producing the source directory, run before deploy and plan (default none)")
+	flags.StringVar(&cfg.BuildDir, "build-dir", "", "Working directory of the build command (default the current directory)")
+	flags.Var(&cfg.BuildEnv, "build-env", "Environment variable of the build command as NAME=value (repeatable)")
+	flags.BoolVar(&cfg.BuildCache, "build-cache", true, "Reuse the output of an earlier build with the same command, lockfiles and sources, cached in --state-bucket")
+	flags.StringVar(&cfg.Routing, "routing", routingSPA, "Routing mode: spa (extensionless paths serve /index.html), static (directory index.html and 404.html) or legacy (every 404 serves /index.html)")
+	flags.StringVar(&cfg.Auth, "auth", authNone, "Protect the preview: none, basic (HTTP basic auth) or cookie (shared-secret cookie set via ?preview_token=)")
+	flags.StringVar(&cfg.AuthSecret, "auth-secret", "", "Secrets Manager secret holding the preview password, as {\"username\", \"password\"} JSON or a plain password")
+	flags.Var(&cfg.AllowCIDRs, "allow-cidr", "Only allow viewers from this IPv4 or IPv6 CIDR through a shared WAF web ACL (repeatable)")
+	flags.StringVar(&cfg.WAFName, "waf-name", "pr-preview-allowlist", "Name of the shared WAF web ACL and its IP sets")
+	flags.BoolVar(&cfg.SecurityHeaders, "security-headers", true, "Send HSTS, X-Content-Type-Options, Referrer-Policy and X-Frame-Options headers")
+	flags.BoolVar(&cfg.Noindex, "noindex", true, "Send X-Robots-Tag: noindex and serve a robots.txt disallowing everything when the build has none")
+	flags.StringVar(&cfg.CSP, "csp", "", "Content-Security-Policy header value (default none)")
+	flags.Var(&cfg.ResponseHeaders, "response-header", "Custom response header as \"Name: value\" (repeatable)")
+	flags.StringVar(&cfg.KMSKeyID, "kms-key-id", "", "KMS key ID or ARN encrypting preview buckets with SSE-KMS (default SSE-S3)")
+	flags.Var(&cfg.CacheRules, "cache-rule", "Cache-Control of uploaded files matching a glob, as \"assets/**=public, max-age=31536000, immutable\" (repeatable, first match wins)")
+	flags.StringVar(&cfg.DeployedComment, "deployed-comment", "", "Go template of the PR comment posted after a deploy (default built in)")
+	flags.StringVar(&cfg.CleanupComment, "cleanup-comment", "", "Go template of the PR comment posted after a cleanup (default built in)")
+	flags.BoolVar(&cfg.Scan, "scan", true, "Scan the source directory for secrets and sensitive files before uploading")
+	flags.Var(&cfg.ScanAllowPaths, "scan-allow-path", "Glob of a source path or file name the scan skips, e.g. \"*.map\" (repeatable)")
+	flags.Var(&cfg.ScanAllowFingerprints, "scan-allow-fingerprint", "Fingerprint of a scan finding to ignore, as printed in the scan report (repeatable)")
+	flags.StringVar(&cfg.ScanKey, "scan-key", "", "Secret key of the HMAC behind scan fingerprints, required by --scan-allow-fingerprint")
+	flags.StringVar(&cfg.Action, "action", "deploy", "Action to perform: deploy, plan, cleanup, extend, sleep, wake, status, list, gc or doctor")
+	flags.StringVar(&cfg.RepoOwner, "repo-owner", "", "GitHub repository owner")
+	flags.StringVar(&cfg.RepoName, "repo-name", "", "GitHub repository name")
+	flags.BoolVar(&cfg.Wait, "wait", false, "Wait for DNS, distribution and invalidation to propagate before commenting")
+	flags.DurationVar(&cfg.DNSTimeout, "dns-timeout", 5*time.Minute, "Maximum time to wait for the Route53 change to be INSYNC")
+	flags.DurationVar(&cfg.DeployTimeout, "deploy-timeout", 30*time.Minute, "Maximum time to wait for the distribution to be Deployed")
+	flags.DurationVar(&cfg.InvalidationTimeout, "invalidation-timeout", 15*time.Minute, "Maximum time to wait for the cache invalidation to complete")
+	flags.IntVar(&cfg.InvalidationMaxPaths, "invalidation-max-paths", 15, "Invalidate changed files individually up to this many paths, then fall back to wildcards")
+	flags.BoolVar(&cfg.Verify, "verify", false, "Run HTTP smoke tests against the preview URL after deploying")
+	flags.Var(&cfg.VerifyPaths, "verify-path", "Additional path that must return 200 (repeatable)")
+	flags.Var(&cfg.VerifyHeaders, "verify-header", "Response header assertion on / as \"Name: value\" or \"Name\" (repeatable)")
+	flags.IntVar(&cfg.VerifyAttempts, "verify-attempts", 10, "Attempts per smoke check before failing")
+	flags.Func("max-age", "gc: tear down previews older than this even if the PR is open, e.g. 30d (default disabled)", func(value string) (err error) {
+		cfg.MaxAge, err = parseDuration(value)
+		return err
+	})
+	flags.Func("ttl", "Expire the preview this long after its last deploy, e.g. 14d (default never)", func(value string) (err error) {
+		cfg.TTL, err = parseDuration(value)
+		return err
+	})
+	flags.BoolVar(&cfg.DryRun, "dry-run", false, "gc: report what would be deleted without deleting anything")
+	flags.BoolVar(&cfg.CollectUntagged, "collect-untagged", false, "gc: also tear down untagged previews, e.g. deployed before repository tags, whose PR in this repository is closed")
+	flags.BoolVar(&cfg.AsyncDelete, "async-delete", false, "Disable the distribution on cleanup and leave its deletion to a later gc run")
+	flags.StringVar(&cfg.StateBucket, "state-bucket", "", "S3 bucket holding the preview registry")
+	flags.StringVar(&cfg.RegistryTable, "registry-table", "", "DynamoDB table holding the preview registry (instead of --state-bucket)")
+	flags.StringVar(&cfg.SHA, "sha", "", "Commit SHA being deployed")
+	flags.BoolVar(&cfg.All, "all", false, "list: include deleted previews")
+	flags.DurationVar(&cfg.LockTTL, "lock-ttl", 2*time.Minute, "Lease of the preview lock, renewed while the command runs")
+	flags.DurationVar(&cfg.LockTimeout, "lock-timeout", 10*time.Minute, "Maximum time to wait for another run to release the preview lock")
+	flags.BoolVar(&cfg.RollbackOnFailure, "rollback-on-failure", false, "Remove the resources a failed deploy created when the preview is brand new")
+	flags.IntVar(&cfg.MaxAttempts, "max-attempts", 8, "Maximum attempts per AWS call on throttling, transient and ETag conflict errors")
+	flags.DurationVar(&cfg.MaxBackoff, "max-backoff", 20*time.Second, "Maximum jittered backoff between AWS call attempts")
+}
+
+func validateConfig(cfg *Config) error {
+	switch cfg.Action {
+	case "deploy", "plan", "cleanup", "extend", "sleep", "wake", "status":
+		if cfg.PRNumber == 0 {
+			return errors.New("PR number is required (--pr)")
+		}
+		if cfg.AppName == "" {
+			return errors.New("App name is required (--app)")
+		}
+		if cfg.BaseDomain == "" {
+			return errors.New("Base domain is required (--domain)")
+		}
+		if cfg.RepoOwner == "" {
+			return errors.New("Repository owner is required (--repo-owner)")
+		}
+	case "list":
+		if cfg.StateBucket == "" && cfg.RegistryTable == "" && cfg.BaseDomain == "" {
+			return errors.New("Base domain (--domain) or a registry (--state-bucket, --registry-table) is required")
+		}
+	case "doctor":
+		if cfg.PRNumber != 0 && cfg.AppName == "" {
+			return errors.New("App name is required with --pr (--app)")
+		}
+	case "gc":
+		if cfg.BaseDomain == "" {
+			return errors.New("Base domain is required (--domain)")
+		}
+		if cfg.RepoOwner == "" || cfg.RepoName == "" {
+			return errors.New("Repository is required (--repo-owner, --repo-name)")
+		}
+	default:
+		return fmt.Errorf("Unknown action: %s", cfg.Action)
+	}
+
+	switch cfg.Routing {
+	case routingSPA, routingStatic, routingLegacy:
+	default:
+		return fmt.Errorf("Unknown routing mode: %s", cfg.Routing)
+	}
+
+	switch cfg.Auth {
+	case authNone:
+	case authBasic, authCookie:
+		if cfg.AuthSecret == "" {
+			return errors.New("Auth secret is required with --auth (--auth-secret)")
+		}
+	default:
+		return fmt.Errorf("Unknown auth mode: %s", cfg.Auth)
+	}
+
+	if _, err := parseCustomHeaders(cfg.ResponseHeaders); err != nil {
+		return err
+	}
+
+	if _, err := parseCacheRules(cfg.CacheRules); err != nil {
+		return err
+	}
+
+	for _, env := range cfg.BuildEnv {
+		if name, _, ok := strings.Cut(env, "="); !ok || name == "" {
+			return fmt.Errorf("invalid build environment variable %q, expected NAME=value", env)
+		}
+	}
+
+	for _, glob := range append(slices.Clone(cfg.AppPaths), cfg.SharedPaths...) {
+		if err := validateGlob(glob); err != nil {
+			return fmt.Errorf("invalid path glob %q: %w", glob, err)
+		}
+	}
+
+	for _, text := range []string{cfg.DeployedComment, cfg.CleanupComment} {
+		if _, err := renderComment(text, "", commentData{}); err != nil {
+			return err
+		}
+	}
+
+	if cfg.MaxAttempts < 1 {
+		return errors.New("--max-attempts must be at least 1")
+	}
+	if len(cfg.ScanAllowFingerprints) > 0 && cfg.ScanKey == "" {
+		return errors.New("--scan-allow-fingerprint requires --scan-key")
+	}
+	if cfg.VerifyAttempts < 1 {
+		return errors.New("--verify-attempts must be at least 1")
+	}
+
+	return nil
+
+}
+
+func newPreviewManager(cfg *Config, awsCfg aws.Config, githubClient *github.Client, out io.Writer) *PreviewManager {
+	bucketName := previewName(cfg.PRNumber, cfg.AppName)
+
+	var registry previewRegistry
+	var locks lockBackend
+	var journals journalStore
+	if cfg.RegistryTable != "" {
+		client := dynamodb.NewFromConfig(awsCfg)
+		dynamo := &dynamoRegistry{client: client, table: cfg.RegistryTable, repo: repoName(cfg)}
+		registry, journals = dynamo, dynamo
+		locks = &dynamoLockBackend{client: client, table: cfg.RegistryTable}
+	} else if cfg.StateBucket != "" {
+		client := s3.NewFromConfig(awsCfg)
+		s3State := &s3Registry{client: client, bucket: cfg.StateBucket, repo: repoName(cfg)}
+		registry, journals = s3State, s3State
+		locks = &s3LockBackend{client: client, bucket: cfg.StateBucket, etags: make(map[string]string), out: out}
+	}
+
+	// Web ACLs for CloudFront can only be managed in us-east-1.
+	wafClient := wafv2.NewFromConfig(awsCfg, func(o *wafv2.Options) {
+		o.Region = "us-east-1"
+	})
+
+	return &PreviewManager{
 		cfg:          cfg,
 		awsCfg:       awsCfg,
 		s3Client:     s3.NewFromConfig(awsCfg),
 		cfClient:     cloudfront.NewFromConfig(awsCfg),
+		smClient:     secretsmanager.NewFromConfig(awsCfg),
+		wafClient:    wafClient,
+		kmsClient:    kms.NewFromConfig(awsCfg),
 		r53Client:    route53.NewFromConfig(awsCfg),
 		githubClient: githubClient,
 		subdomain:    bucketName,
 		bucketName:   bucketName,
 		fullDomain:   fmt.Sprintf("%s.%s", bucketName, cfg.BaseDomain),
+		registry:     registry,
+		locks:        locks,
+		journals:     journals,
+		out:          out,
 	}
+}
 
-	if cfg.Action == "cleanup" {
-		if err := pm.Cleanup(ctx); err != nil {
-			log.Fatalf("Cleanup failed: %v", err)
-		}
-		fmt.Println("Cleanup completed successfully")
-	} else {
-		if err := pm.Deploy(ctx); err != nil {
-			log.Fatalf("Deployment failed: %v", err)
+// forPreview returns a manager for another preview sharing this one's
+// settings and clients.
+func (pm *PreviewManager) forPreview(prNumber int, appName string) *PreviewManager {
+	cfg := *pm.cfg
+	cfg.PRNumber = prNumber
+	cfg.AppName = appName
+
+	other := newPreviewManager(&cfg, pm.awsCfg, pm.githubClient, pm.out)
+	other.hostedZoneID = pm.hostedZoneID
+	return other
+}
+
+// previewName is used for the bucket name and the subdomain of a preview.
+func previewName(prNumber int, appName string) string {
+	return fmt.Sprintf("pr-%d-%s", prNumber, appName)
+}
+
+// parseDuration is time.ParseDuration with support for a "d" (days) suffix.
+func parseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
 		}
-		fmt.Printf("\n✓ Preview environment deployed successfully!\n")
-		fmt.Printf("URL: https://%s\n", pm.fullDomain)
-		fmt.Printf("Note: Initial deployment may take 3-5 minutes for CloudFront to propagate globally.\n")
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// formatDuration prints whole days as "14d" and anything else as
+// time.Duration does.
+func formatDuration(d time.Duration) string {
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func newTableWriter(out io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02 15:04")
+}
+
+func formatExpiry(expiry *previewExpiry) string {
+	if expiry == nil {
+		return "-"
+	}
+	if expiry.Warned {
+		return formatTime(&expiry.ExpiresAt) + " (warned)"
 	}
+	return formatTime(&expiry.ExpiresAt)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// stringList collects the values of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
 func getContentType(filename string) string {
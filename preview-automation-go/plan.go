@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Plan reports what a deploy would do without changing anything: the source
+// scan, the resources it would create, the files a sync would upload and
+// delete and the paths it would invalidate. It fails like a deploy would
+// when the scan finds secrets. A build command does run, since its output is
+// what would be uploaded.
+func (pm *PreviewManager) Plan(ctx context.Context) error {
+	fmt.Fprintf(pm.out, "Planning deploy of %s to https://%s...\n", pm.cfg.SourcePath, pm.fullDomain)
+
+	if err := pm.build(ctx); err != nil {
+		return err
+	}
+
+	scanErr := pm.scanSource(ctx)
+	var findings *scanError
+	if scanErr != nil && !errors.As(scanErr, &findings) {
+		return scanErr
+	}
+
+	bucket := "exists"
+	existing := make(map[string]string)
+	_, err := pm.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(pm.bucketName),
+	})
+	var notFound *s3types.NotFound
+	switch {
+	case errors.As(err, &notFound):
+		bucket = "create"
+	case err != nil:
+		return fmt.Errorf("failed to check bucket: %w", err)
+	default:
+		if existing, err = pm.listObjectETags(ctx); err != nil {
+			return err
+		}
+	}
+
+	result, err := pm.compareSource(ctx, existing, false)
+	if err != nil {
+		return err
+	}
+
+	distributionID, err := pm.findCloudFrontDistribution(ctx)
+	if err != nil {
+		return err
+	}
+
+	distribution := distributionID
+	invalidation := "none, nothing changed"
+	switch {
+	case distributionID == "":
+		distribution = "create"
+		invalidation = "none, new distribution"
+	case len(result.changedKeys()) > 0:
+		invalidation = strings.Join(invalidationPaths(result.changedKeys(), pm.cfg.InvalidationMaxPaths), ", ")
+	}
+
+	scan := "ok"
+	switch {
+	case !pm.cfg.Scan:
+		scan = "disabled"
+	case findings != nil:
+		scan = fmt.Sprintf("%d finding(s), the deploy would fail", len(findings.Findings))
+	}
+
+	fmt.Fprintln(pm.out, "\nPlan:")
+	w := newTableWriter(pm.out)
+	if pm.built != nil {
+		fmt.Fprintf(w, "  Build:\t%s\n", pm.built)
+	}
+	fmt.Fprintf(w, "  Scan:\t%s\n", scan)
+	fmt.Fprintf(w, "  Bucket:\t%s (%s)\n", pm.bucketName, bucket)
+	fmt.Fprintf(w, "  Distribution:\t%s\n", distribution)
+	fmt.Fprintf(w, "  Files:\t%d to upload, %d to update headers, %d to delete, %d unchanged\n", len(result.Uploaded), len(result.Updated), len(result.Deleted), result.Unchanged)
+	fmt.Fprintf(w, "  Invalidation:\t%s\n", invalidation)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, key := range result.Uploaded {
+		fmt.Fprintf(pm.out, "    + %s\n", key)
+	}
+	for _, key := range result.Updated {
+		fmt.Fprintf(pm.out, "    ~ %s\n", key)
+	}
+	for _, key := range result.Deleted {
+		fmt.Fprintf(pm.out, "    - %s\n", key)
+	}
+
+	return scanErr
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// policyDocument is an IAM policy document, used for bucket and key policies.
+type policyDocument struct {
+	Version   string        `json:"Version"`
+	ID        string        `json:"Id,omitempty"`
+	Statement statementList `json:"Statement"`
+}
+
+// statementList is the statements of a policy, which IAM also accepts as a
+// single object. It is always written back as a list.
+type statementList []policyStatement
+
+func (l *statementList) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var statement policyStatement
+		if err := json.Unmarshal(data, &statement); err != nil {
+			return err
+		}
+		*l = statementList{statement}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]policyStatement)(l))
+}
+
+type policyStatement struct {
+	Sid          string                             `json:"Sid,omitempty"`
+	Effect       string                             `json:"Effect"`
+	Principal    *policyPrincipal                   `json:"Principal,omitempty"`
+	NotPrincipal *policyPrincipal                   `json:"NotPrincipal,omitempty"`
+	Action       stringOrList                       `json:"Action,omitempty"`
+	NotAction    stringOrList                       `json:"NotAction,omitempty"`
+	Resource     stringOrList                       `json:"Resource,omitempty"`
+	NotResource  stringOrList                       `json:"NotResource,omitempty"`
+	Condition    map[string]map[string]stringOrList `json:"Condition,omitempty"`
+}
+
+// stringOrList is a policy value written either as a string or as a list.
+// Scalars such as booleans in conditions are read as strings.
+type stringOrList []string
+
+func (l stringOrList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l *stringOrList) UnmarshalJSON(data []byte) error {
+	var values []any
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+	} else {
+		var value any
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		values = []any{value}
+	}
+
+	*l = make(stringOrList, 0, len(values))
+	for _, value := range values {
+		*l = append(*l, fmt.Sprint(value))
+	}
+	return nil
+}
+
+// policyPrincipal is either "*" or a map such as {"Service": "..."}.
+type policyPrincipal struct {
+	All    bool
+	Values map[string]stringOrList
+}
+
+func (p policyPrincipal) MarshalJSON() ([]byte, error) {
+	if p.All {
+		return json.Marshal("*")
+	}
+	return json.Marshal(p.Values)
+}
+
+func (p *policyPrincipal) UnmarshalJSON(data []byte) error {
+	var all string
+	if err := json.Unmarshal(data, &all); err == nil {
+		if all != "*" {
+			return fmt.Errorf("unexpected principal %q", all)
+		}
+		p.All = true
+		return nil
+	}
+	return json.Unmarshal(data, &p.Values)
+}
+
+func parsePolicy(policy string) (*policyDocument, error) {
+	doc := &policyDocument{}
+	if err := json.Unmarshal([]byte(policy), doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (d *policyDocument) statement(sid string) *policyStatement {
+	for i := range d.Statement {
+		if d.Statement[i].Sid == sid {
+			return &d.Statement[i]
+		}
+	}
+	return nil
+}
+
+// merge replaces the statements with the Sids of managed in place and appends
+// the missing ones, leaving every other statement untouched. It returns one
+// diff line per statement added or changed.
+func (d *policyDocument) merge(managed []policyStatement) []string {
+	if d.Version == "" {
+		d.Version = "2012-10-17"
+	}
+
+	var diff []string
+	for _, statement := range managed {
+		existing := d.statement(statement.Sid)
+		if existing == nil {
+			d.Statement = append(d.Statement, statement)
+			diff = append(diff, "+ "+statement.String())
+			continue
+		}
+		if existing.String() != statement.String() {
+			diff = append(diff, "- "+existing.String(), "+ "+statement.String())
+			*existing = statement
+		}
+	}
+	return diff
+}
+
+func (s policyStatement) String() string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func (d *policyDocument) String() string {
+	data, _ := json.Marshal(d)
+	return string(data)
+}
+
+func servicePrincipal(service string) *policyPrincipal {
+	return &policyPrincipal{Values: map[string]stringOrList{"Service": {service}}}
+}
+
+// bucketPolicyStatements are the statements the tool manages in preview
+// bucket policies. ListBucket makes S3 answer 404 rather than 403 for
+// missing objects.
+func (pm *PreviewManager) bucketPolicyStatements(distributionARNs []string) []policyStatement {
+	bucketARN := "arn:aws:s3:::" + pm.bucketName
+	fromDistributions := map[string]map[string]stringOrList{
+		"StringEquals": {"AWS:SourceArn": distributionARNs},
+	}
+
+	return []policyStatement{
+		{
+			Sid:       "AllowCloudFrontServicePrincipal",
+			Effect:    "Allow",
+			Principal: servicePrincipal("cloudfront.amazonaws.com"),
+			Action:    stringOrList{"s3:GetObject"},
+			Resource:  stringOrList{bucketARN + "/*"},
+			Condition: fromDistributions,
+		},
+		{
+			Sid:       "AllowCloudFrontListBucket",
+			Effect:    "Allow",
+			Principal: servicePrincipal("cloudfront.amazonaws.com"),
+			Action:    stringOrList{"s3:ListBucket"},
+			Resource:  stringOrList{bucketARN},
+			Condition: fromDistributions,
+		},
+		{
+			Sid:       denyInsecureTransportSid,
+			Effect:    "Deny",
+			Principal: &policyPrincipal{All: true},
+			Action:    stringOrList{"s3:*"},
+			Resource:  stringOrList{bucketARN, bucketARN + "/*"},
+			Condition: map[string]map[string]stringOrList{
+				"Bool": {"aws:SecureTransport": {"false"}},
+			},
+		},
+	}
+}
+
+// grantedDistributionARNs returns the distributions the bucket policy
+// already grants access to, so that a distribution being migrated to does
+// not lock out the one still serving the preview.
+func grantedDistributionARNs(doc *policyDocument) []string {
+	statement := doc.statement("AllowCloudFrontServicePrincipal")
+	if statement == nil {
+		return nil
+	}
+	return statement.Condition["StringEquals"]["AWS:SourceArn"]
+}
+
+// liveDistributionARNs drops the ARNs of distributions that no longer exist.
+func (pm *PreviewManager) liveDistributionARNs(ctx context.Context, arns []string) ([]string, error) {
+	var live []string
+	for _, arn := range arns {
+		_, id, found := strings.Cut(arn, ":distribution/")
+		if !found {
+			continue
+		}
+		_, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+			Id: aws.String(id),
+		})
+		var noSuchDistribution *cftypes.NoSuchDistribution
+		if errors.As(err, &noSuchDistribution) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get distribution: %w", err)
+		}
+		live = append(live, arn)
+	}
+	return live, nil
+}
+
+// getBucketPolicy returns the policy of the preview bucket, or an empty one.
+func (pm *PreviewManager) getBucketPolicy(ctx context.Context, bucket string) (*policyDocument, error) {
+	result, err := pm.s3Client.GetBucketPolicy(ctx, &s3.GetBucketPolicyInput{
+		Bucket: aws.String(bucket),
+	})
+	if isNotConfigured(err) {
+		return &policyDocument{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bucket policy: %w", err)
+	}
+
+	doc, err := parsePolicy(aws.ToString(result.Policy))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bucket policy: %w", err)
+	}
+	return doc, nil
+}
+
+// printPolicyDiff prints the statements a policy update changes.
+func (pm *PreviewManager) printPolicyDiff(diff []string) {
+	for _, line := range diff {
+		fmt.Fprintf(pm.out, "    %s\n", line)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPolicyMerge(t *testing.T) {
+	managed := []policyStatement{
+		{
+			Sid:       "Managed",
+			Effect:    "Allow",
+			Principal: servicePrincipal("cloudfront.amazonaws.com"),
+			Action:    stringOrList{"s3:GetObject"},
+			Resource:  stringOrList{"arn:aws:s3:::pr-1-web/*"},
+		},
+		{
+			Sid:       denyInsecureTransportSid,
+			Effect:    "Deny",
+			Principal: &policyPrincipal{All: true},
+			Action:    stringOrList{"s3:*"},
+			Resource:  stringOrList{"arn:aws:s3:::pr-1-web", "arn:aws:s3:::pr-1-web/*"},
+			Condition: map[string]map[string]stringOrList{"Bool": {"aws:SecureTransport": {"false"}}},
+		},
+	}
+	foreign := `{"Sid":"SecurityTooling","Effect":"Deny","Principal":"*","Action":"s3:DeleteBucket","Resource":"arn:aws:s3:::pr-1-web"}`
+	staleManaged := `{"Sid":"Managed","Effect":"Allow","Principal":{"Service":"cloudfront.amazonaws.com"},"Action":"s3:GetObject","Resource":"arn:aws:s3:::old/*"}`
+
+	tests := []struct {
+		name     string
+		policy   string
+		wantSids []string
+		wantDiff int
+	}{
+		{
+			name:     "statement list",
+			policy:   `{"Version":"2012-10-17","Statement":[` + foreign + `,` + staleManaged + `]}`,
+			wantSids: []string{"SecurityTooling", "Managed", denyInsecureTransportSid},
+			wantDiff: 3,
+		},
+		{
+			name:     "single statement object",
+			policy:   `{"Version":"2012-10-17","Statement":` + foreign + `}`,
+			wantSids: []string{"SecurityTooling", "Managed", denyInsecureTransportSid},
+			wantDiff: 2,
+		},
+		{
+			name:     "single managed statement object",
+			policy:   `{"Version":"2012-10-17","Statement":` + staleManaged + `}`,
+			wantSids: []string{"Managed", denyInsecureTransportSid},
+			wantDiff: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parsePolicy(tt.policy)
+			if err != nil {
+				t.Fatalf("parsePolicy() error = %v", err)
+			}
+
+			diff := doc.merge(managed)
+			if len(diff) != tt.wantDiff {
+				t.Errorf("merge() diff = %q, want %d lines", diff, tt.wantDiff)
+			}
+			var sids []string
+			for _, s := range doc.Statement {
+				sids = append(sids, s.Sid)
+			}
+			if strings.Join(sids, ",") != strings.Join(tt.wantSids, ",") {
+				t.Errorf("merged Sids = %q, want %q", sids, tt.wantSids)
+			}
+			if got := doc.statement("Managed").String(); got != managed[0].String() {
+				t.Errorf("Managed statement = %s, want %s", got, managed[0].String())
+			}
+
+			// The merged policy is written back with a statement list and
+			// reads back unchanged.
+			var raw struct {
+				Statement json.RawMessage
+			}
+			if err := json.Unmarshal([]byte(doc.String()), &raw); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(raw.Statement), "[") {
+				t.Errorf("Statement written as %s, want a list", raw.Statement)
+			}
+			again, err := parsePolicy(doc.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(again.merge(managed)) != 0 {
+				t.Errorf("merging twice changed the policy")
+			}
+		})
+	}
+}
+
+func TestPolicyMergeEmpty(t *testing.T) {
+	doc := &policyDocument{}
+	doc.merge([]policyStatement{{Sid: "A", Effect: "Allow"}})
+	if doc.Version != "2012-10-17" {
+		t.Errorf("Version = %q, want 2012-10-17", doc.Version)
+	}
+	if len(doc.Statement) != 1 {
+		t.Errorf("got %d statements, want 1", len(doc.Statement))
+	}
+}
+
+func TestStringOrList(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{`"s3:GetObject"`, "s3:GetObject"},
+		{`["s3:GetObject","s3:ListBucket"]`, "s3:GetObject,s3:ListBucket"},
+		{`true`, "true"},
+	}
+	for _, tt := range tests {
+		var l stringOrList
+		if err := json.Unmarshal([]byte(tt.json), &l); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", tt.json, err)
+		}
+		if got := strings.Join(l, ","); got != tt.want {
+			t.Errorf("Unmarshal(%s) = %q, want %q", tt.json, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Preview record statuses.
+const (
+	recordActive   = "active"
+	recordSleeping = "sleeping"
+	recordDeleting = "deleting"
+	recordDeleted  = "deleted"
+)
+
+// previewRecord is the registry entry describing one preview.
+type previewRecord struct {
+	PRNumber       int        `json:"pr"`
+	AppName        string     `json:"app"`
+	Repo           string     `json:"repo"`
+	Domain         string     `json:"domain"`
+	SHA            string     `json:"sha,omitempty"`
+	Status         string     `json:"status"`
+	BucketName     string     `json:"bucket"`
+	DistributionID string     `json:"distributionId,omitempty"`
+	OACID          string     `json:"oacId,omitempty"`
+	HostedZoneID   string     `json:"hostedZoneId,omitempty"`
+	CreatedBy      string     `json:"createdBy,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	LastDeployedAt *time.Time `json:"lastDeployedAt,omitempty"`
+	DeletedAt      *time.Time `json:"deletedAt,omitempty"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+	TTL            string     `json:"ttl,omitempty"`
+	ExpiryWarned   bool       `json:"expiryWarned,omitempty"`
+}
+
+func (r *previewRecord) key() previewKey {
+	return previewKey{PRNumber: r.PRNumber, AppName: r.AppName}
+}
+
+func (r *previewRecord) expiry() *previewExpiry {
+	if r.ExpiresAt == nil {
+		return nil
+	}
+	ttl, _ := parseDuration(r.TTL)
+	return &previewExpiry{ExpiresAt: *r.ExpiresAt, TTL: ttl, Warned: r.ExpiryWarned}
+}
+
+// registryID is the document key of a preview in either backend. It starts
+// with the repository so repositories can share a registry.
+func registryID(repo string, key previewKey) string {
+	return registryPrefix(repo) + fmt.Sprintf("%s/pr-%d", key.AppName, key.PRNumber)
+}
+
+func registryPrefix(repo string) string {
+	if repo == "" {
+		return ""
+	}
+	return repo + "/"
+}
+
+// previewRegistry stores preview records so commands don't have to rediscover
+// previews by scanning the account.
+type previewRegistry interface {
+	// Get returns nil without an error when the preview has no record.
+	Get(ctx context.Context, key previewKey) (*previewRecord, error)
+	Put(ctx context.Context, record *previewRecord) error
+	List(ctx context.Context) ([]*previewRecord, error)
+}
+
+// s3Registry keeps one JSON document per preview in a state bucket.
+type s3Registry struct {
+	client *s3.Client
+	bucket string
+	repo   string
+}
+
+const s3RegistryPrefix = "previews/"
+
+func (r *s3Registry) objectKey(key previewKey) string {
+	return s3RegistryPrefix + registryID(r.repo, key) + ".json"
+}
+
+func (r *s3Registry) Get(ctx context.Context, key previewKey) (*previewRecord, error) {
+	result, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.objectKey(key)),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read registry record: %w", err)
+	}
+	defer result.Body.Close()
+
+	var record previewRecord
+	if err := json.NewDecoder(result.Body).Decode(&record); err != nil {
+		return nil, fmt.Errorf("failed to decode registry record: %w", err)
+	}
+	return &record, nil
+}
+
+func (r *s3Registry) Put(ctx context.Context, record *previewRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucket),
+		Key:         aws.String(r.objectKey(record.key())),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write registry record: %w", err)
+	}
+	return nil
+}
+
+func (r *s3Registry) List(ctx context.Context) ([]*previewRecord, error) {
+	var records []*previewRecord
+
+	paginator := s3.NewListObjectsV2Paginator(r.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(s3RegistryPrefix + registryPrefix(r.repo)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list registry records: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			result, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(r.bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to read registry record %s: %w", *obj.Key, err)
+			}
+
+			var record previewRecord
+			err = json.NewDecoder(result.Body).Decode(&record)
+			result.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode registry record %s: %w", *obj.Key, err)
+			}
+			records = append(records, &record)
+		}
+	}
+
+	return records, nil
+}
+
+// dynamoRegistry keeps one item per preview, keyed by "id", with the record
+// JSON in the "record" attribute.
+type dynamoRegistry struct {
+	client *dynamodb.Client
+	table  string
+	repo   string
+}
+
+func (r *dynamoRegistry) Get(ctx context.Context, key previewKey) (*previewRecord, error) {
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]ddbtypes.AttributeValue{
+			"id": &ddbtypes.AttributeValueMemberS{Value: registryID(r.repo, key)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry record: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	return decodeDynamoRecord(result.Item)
+}
+
+func (r *dynamoRegistry) Put(ctx context.Context, record *previewRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.table),
+		Item: map[string]ddbtypes.AttributeValue{
+			"id":     &ddbtypes.AttributeValueMemberS{Value: registryID(r.repo, record.key())},
+			"status": &ddbtypes.AttributeValueMemberS{Value: record.Status},
+			"record": &ddbtypes.AttributeValueMemberS{Value: string(data)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write registry record: %w", err)
+	}
+	return nil
+}
+
+func (r *dynamoRegistry) List(ctx context.Context) ([]*previewRecord, error) {
+	var records []*previewRecord
+
+	paginator := dynamodb.NewScanPaginator(r.client, &dynamodb.ScanInput{
+		TableName:      aws.String(r.table),
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list registry records: %w", err)
+		}
+		for _, item := range page.Items {
+			// Locks share the table with the records, and other
+			// repositories may too.
+			if _, ok := item["record"]; !ok {
+				continue
+			}
+			if id, ok := item["id"].(*ddbtypes.AttributeValueMemberS); !ok || !strings.HasPrefix(id.Value, registryPrefix(r.repo)) {
+				continue
+			}
+			record, err := decodeDynamoRecord(item)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func decodeDynamoRecord(item map[string]ddbtypes.AttributeValue) (*previewRecord, error) {
+	attr, ok := item["record"].(*ddbtypes.AttributeValueMemberS)
+	if !ok {
+		return nil, fmt.Errorf("registry item has no record attribute")
+	}
+
+	var record previewRecord
+	if err := json.Unmarshal([]byte(attr.Value), &record); err != nil {
+		return nil, fmt.Errorf("failed to decode registry record: %w", err)
+	}
+	return &record, nil
+}
+
+// updateRecord applies mutate to the registry record of the preview,
+// creating it if needed. It is a no-op when no registry is configured.
+func (pm *PreviewManager) updateRecord(ctx context.Context, mutate func(*previewRecord)) error {
+	if pm.registry == nil {
+		return nil
+	}
+
+	key := previewKey{PRNumber: pm.cfg.PRNumber, AppName: pm.cfg.AppName}
+	record, err := pm.registry.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if record == nil {
+		record = &previewRecord{
+			PRNumber:  pm.cfg.PRNumber,
+			AppName:   pm.cfg.AppName,
+			CreatedBy: os.Getenv("GITHUB_ACTOR"),
+			CreatedAt: now,
+		}
+	}
+
+	record.Repo = pm.repo()
+	record.Domain = pm.fullDomain
+	record.BucketName = pm.bucketName
+	mutate(record)
+	record.UpdatedAt = now
+
+	return pm.registry.Put(ctx, record)
+}
+
+// List prints every preview, from the registry when one is configured and
+// by scanning the account otherwise.
+func (pm *PreviewManager) List(ctx context.Context) error {
+	if pm.registry == nil {
+		previews, err := pm.discoverPreviews(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := newTableWriter(pm.out)
+		fmt.Fprintln(w, "PREVIEW\tRESOURCES\tCREATED\tEXPIRES")
+		for _, p := range previews {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", previewName(p.PRNumber, p.AppName), p.resources(), formatTime(&p.CreatedAt), formatExpiry(p.Expiry))
+		}
+		return w.Flush()
+	}
+
+	records, err := pm.registry.List(ctx)
+	if err != nil {
+		return err
+	}
+	sortRecords(records)
+
+	w := newTableWriter(pm.out)
+	fmt.Fprintln(w, "PREVIEW\tSTATUS\tSHA\tCREATED BY\tCREATED\tLAST DEPLOYED\tEXPIRES")
+	for _, r := range records {
+		if r.Status == recordDeleted && !pm.cfg.All {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", previewName(r.PRNumber, r.AppName), r.Status, shortSHA(r.SHA),
+			orDash(r.CreatedBy), formatTime(&r.CreatedAt), formatTime(r.LastDeployedAt), formatExpiry(r.expiry()))
+	}
+	return w.Flush()
+}
+
+func sortRecords(records []*previewRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].PRNumber != records[j].PRNumber {
+			return records[i].PRNumber < records[j].PRNumber
+		}
+		return records[i].AppName < records[j].AppName
+	})
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return orDash(sha)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// retryableErrorCodes are retried on top of the SDK defaults. CloudFront
+// reports throttling under several codes, Route53 rejects changes while a
+// previous one on the same zone is still being applied, and S3 returns
+// OperationAborted while a conflicting bucket operation is in progress.
+var retryableErrorCodes = map[string]struct{}{
+	"Throttling":                             {},
+	"ThrottlingException":                    {},
+	"TooManyRequests":                        {},
+	"TooManyRequestsException":               {},
+	"RequestLimitExceeded":                   {},
+	"ServiceUnavailable":                     {},
+	"PriorRequestNotComplete":                {},
+	"OperationAborted":                       {},
+	"InternalError":                          {},
+	"InternalFailure":                        {},
+	"ProvisionedThroughputExceededException": {},
+}
+
+// newRetryer returns the retry policy used by every AWS client: jittered
+// exponential backoff up to cfg.MaxBackoff for cfg.MaxAttempts attempts.
+// The client-side retry quota is disabled since a throttled control plane is
+// exactly when a CI run needs to keep retrying.
+func newRetryer(cfg *Config) func() aws.Retryer {
+	return func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = cfg.MaxAttempts
+			o.MaxBackoff = cfg.MaxBackoff
+			o.Backoff = retry.NewExponentialJitterBackoff(cfg.MaxBackoff)
+			o.RateLimiter = ratelimit.None
+			o.Retryables = append(o.Retryables, retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+				var apiErr smithy.APIError
+				if errors.As(err, &apiErr) {
+					if _, ok := retryableErrorCodes[apiErr.ErrorCode()]; ok {
+						return aws.TrueTernary
+					}
+				}
+				return aws.UnknownTernary
+			}))
+		})
+	}
+}
+
+// isETagConflict reports whether a CloudFront write lost a race with another
+// writer and should be retried with a fresh ETag.
+func isETagConflict(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "InvalidIfMatchVersion":
+		return true
+	}
+	return false
+}
+
+// retryOnConflict calls fn, which must read the current ETag itself, until it
+// no longer fails with an ETag conflict.
+func (pm *PreviewManager) retryOnConflict(ctx context.Context, what string, fn func() error) error {
+	backoff := retry.NewExponentialJitterBackoff(pm.cfg.MaxBackoff)
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isETagConflict(err) || attempt >= pm.cfg.MaxAttempts {
+			return err
+		}
+
+		delay, backoffErr := backoff.BackoffDelay(attempt, err)
+		if backoffErr != nil {
+			return err
+		}
+		fmt.Fprintf(pm.out, "  %s changed concurrently, retrying in %s (attempt %d/%d)\n", what, delay.Round(time.Millisecond), attempt+1, pm.cfg.MaxAttempts)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+// Routing modes.
+const (
+	// routingSPA serves /index.html for every extensionless path and real
+	// 404s for missing files.
+	routingSPA = "spa"
+	// routingStatic resolves directory index.html files and serves 404.html
+	// for missing pages.
+	routingStatic = "static"
+	// routingLegacy maps every 404 to /index.html with status 200.
+	routingLegacy = "legacy"
+)
+
+const spaRoutingCode = `
+    var last = request.uri.substring(request.uri.lastIndexOf('/') + 1);
+    if (last.indexOf('.') === -1) {
+        request.uri = '/index.html';
+    }
+`
+
+const staticRoutingCode = `
+    var uri = request.uri;
+    if (uri.endsWith('/')) {
+        request.uri = uri + 'index.html';
+    } else if (uri.substring(uri.lastIndexOf('/') + 1).indexOf('.') === -1) {
+        request.uri = uri + '/index.html';
+    }
+`
+
+// functionPrefix starts the names of the viewer-request functions.
+const functionPrefix = "pr-preview-"
+
+// viewerRequestCode returns the viewer-request function enforcing auth and
+// the routing mode, or "" when neither needs a function.
+func viewerRequestCode(mode string, auth *previewAuth) string {
+	var routing string
+	switch mode {
+	case routingSPA:
+		routing = spaRoutingCode
+	case routingStatic:
+		routing = staticRoutingCode
+	}
+
+	declarations, check := viewerRequestAuthCode(auth)
+	if routing == "" && check == "" {
+		return ""
+	}
+
+	return declarations + "function handler(event) {\n    var request = event.request;\n" + check + routing + "    return request;\n}\n"
+}
+
+// ensureViewerRequestFunction returns the ARN of the published viewer-request
+// function for the preview, creating and publishing it if needed. Functions
+// are named after a hash of their code, so previews with the same settings
+// share one and a changed function, e.g. after a secret rotation, never
+// affects running previews. Returns "" when no function is needed.
+func (pm *PreviewManager) ensureViewerRequestFunction(ctx context.Context) (string, error) {
+	code := viewerRequestCode(pm.cfg.Routing, pm.auth)
+	if code == "" {
+		return "", nil
+	}
+
+	sum := sha256.Sum256([]byte(code))
+	name := functionPrefix + hex.EncodeToString(sum[:])[:16]
+
+	fmt.Fprintf(pm.out, "Managing CloudFront Function %s (%s routing, %s auth)...\n", name, pm.cfg.Routing, pm.cfg.Auth)
+
+	live, err := pm.cfClient.DescribeFunction(ctx, &cloudfront.DescribeFunctionInput{
+		Name:  aws.String(name),
+		Stage: cftypes.FunctionStageLive,
+	})
+	if err == nil {
+		fmt.Fprintln(pm.out, "  ✓ Using existing function")
+		return aws.ToString(live.FunctionSummary.FunctionMetadata.FunctionARN), nil
+	}
+	var noSuchFunction *cftypes.NoSuchFunctionExists
+	if !errors.As(err, &noSuchFunction) {
+		return "", fmt.Errorf("failed to describe function: %w", err)
+	}
+
+	// Another run may have created it without publishing it yet.
+	etag, err := pm.createFunction(ctx, name, code)
+	if err != nil {
+		return "", err
+	}
+
+	published, err := pm.cfClient.PublishFunction(ctx, &cloudfront.PublishFunctionInput{
+		Name:    aws.String(name),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to publish function: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ Function published")
+	return aws.ToString(published.FunctionSummary.FunctionMetadata.FunctionARN), nil
+}
+
+// createFunction creates the function, or finds the unpublished one another
+// run created, and returns its development ETag.
+func (pm *PreviewManager) createFunction(ctx context.Context, name, code string) (string, error) {
+	created, err := pm.cfClient.CreateFunction(ctx, &cloudfront.CreateFunctionInput{
+		Name:         aws.String(name),
+		FunctionCode: []byte(code),
+		FunctionConfig: &cftypes.FunctionConfig{
+			Comment: aws.String(fmt.Sprintf("PR preview viewer-request (%s routing, %s auth)", pm.cfg.Routing, pm.cfg.Auth)),
+			Runtime: cftypes.FunctionRuntimeCloudfrontJs20,
+		},
+	})
+	if err == nil {
+		return aws.ToString(created.ETag), nil
+	}
+
+	var alreadyExists *cftypes.FunctionAlreadyExists
+	if !errors.As(err, &alreadyExists) {
+		return "", fmt.Errorf("failed to create function: %w", err)
+	}
+
+	development, err := pm.cfClient.DescribeFunction(ctx, &cloudfront.DescribeFunctionInput{
+		Name:  aws.String(name),
+		Stage: cftypes.FunctionStageDevelopment,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe function: %w", err)
+	}
+	return aws.ToString(development.ETag), nil
+}
+
+// routingErrorResponse returns the 404 error response of the routing mode,
+// or nil when the mode has none.
+func routingErrorResponse(mode string) *cftypes.CustomErrorResponse {
+	switch mode {
+	case routingLegacy:
+		return &cftypes.CustomErrorResponse{
+			ErrorCode:          aws.Int32(404),
+			ResponsePagePath:   aws.String("/index.html"),
+			ResponseCode:       aws.String("200"),
+			ErrorCachingMinTTL: aws.Int64(300),
+		}
+	case routingStatic:
+		return &cftypes.CustomErrorResponse{
+			ErrorCode:          aws.Int32(404),
+			ResponsePagePath:   aws.String("/404.html"),
+			ResponseCode:       aws.String("404"),
+			ErrorCachingMinTTL: aws.Int64(10),
+		}
+	default:
+		return nil
+	}
+}
+
+// isPreviewFunction reports whether the function ARN is one of the
+// viewer-request functions this tool creates.
+func isPreviewFunction(functionARN string) bool {
+	_, name, _ := strings.Cut(functionARN, ":function/")
+	return strings.HasPrefix(name, functionPrefix)
+}
+
+// isRoutingErrorResponse reports whether the error response is one that a
+// routing mode sets.
+func isRoutingErrorResponse(response cftypes.CustomErrorResponse) bool {
+	for _, mode := range []string{routingLegacy, routingStatic} {
+		if errorResponseKey(response) == errorResponseKey(*routingErrorResponse(mode)) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRouting sets the viewer-request function association and the 404
+// error response of the routing mode on the distribution config and reports
+// whether anything changed. Other associations and error responses are kept,
+// and so are a viewer-request function or 404 response that the tool did not
+// set, unless the routing mode needs to replace them.
+func applyRouting(cfg *cftypes.DistributionConfig, mode, functionARN string) bool {
+	behavior := cfg.DefaultCacheBehavior
+
+	var associations []cftypes.FunctionAssociation
+	if behavior.FunctionAssociations != nil {
+		for _, a := range behavior.FunctionAssociations.Items {
+			if a.EventType == cftypes.EventTypeViewerRequest && (functionARN != "" || isPreviewFunction(aws.ToString(a.FunctionARN))) {
+				continue
+			}
+			associations = append(associations, a)
+		}
+	}
+	if functionARN != "" {
+		associations = append(associations, cftypes.FunctionAssociation{
+			EventType:   cftypes.EventTypeViewerRequest,
+			FunctionARN: aws.String(functionARN),
+		})
+	}
+
+	ours := routingErrorResponse(mode)
+	var responses []cftypes.CustomErrorResponse
+	if cfg.CustomErrorResponses != nil {
+		for _, r := range cfg.CustomErrorResponses.Items {
+			if aws.ToInt32(r.ErrorCode) == 404 && (ours != nil || isRoutingErrorResponse(r)) {
+				continue
+			}
+			responses = append(responses, r)
+		}
+	}
+	if ours != nil {
+		responses = append(responses, *ours)
+	}
+
+	newAssociations := &cftypes.FunctionAssociations{Quantity: aws.Int32(int32(len(associations))), Items: associations}
+	newResponses := &cftypes.CustomErrorResponses{Quantity: aws.Int32(int32(len(responses))), Items: responses}
+	if functionAssociationsKey(behavior.FunctionAssociations) == functionAssociationsKey(newAssociations) &&
+		errorResponsesKey(cfg.CustomErrorResponses) == errorResponsesKey(newResponses) {
+		return false
+	}
+
+	behavior.FunctionAssociations = newAssociations
+	cfg.CustomErrorResponses = newResponses
+	return true
+}
+
+func functionAssociationsKey(associations *cftypes.FunctionAssociations) string {
+	if associations == nil {
+		return ""
+	}
+	var parts []string
+	for _, a := range associations.Items {
+		parts = append(parts, fmt.Sprintf("%s=%s", a.EventType, aws.ToString(a.FunctionARN)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func errorResponsesKey(responses *cftypes.CustomErrorResponses) string {
+	if responses == nil {
+		return ""
+	}
+	var parts []string
+	for _, r := range responses.Items {
+		parts = append(parts, errorResponseKey(r))
+	}
+	return strings.Join(parts, ",")
+}
+
+func errorResponseKey(r cftypes.CustomErrorResponse) string {
+	return fmt.Sprintf("%d:%s:%s:%d", aws.ToInt32(r.ErrorCode), aws.ToString(r.ResponsePagePath),
+		aws.ToString(r.ResponseCode), aws.ToInt64(r.ErrorCachingMinTTL))
+}
+
+// unusedGracePeriod keeps gc from deleting a function or response headers
+// policy that a running deploy has created but not attached yet.
+const unusedGracePeriod = time.Hour
+
+// deleteUnusedFunctions deletes the viewer-request functions that no
+// distribution references, e.g. after a secret rotation or a routing change.
+func (pm *PreviewManager) deleteUnusedFunctions(ctx context.Context) error {
+	fmt.Fprintln(pm.out, "Deleting unused CloudFront Functions...")
+
+	distributions, err := pm.listDistributions(ctx)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, dist := range distributions {
+		var associations []*cftypes.FunctionAssociations
+		if dist.DefaultCacheBehavior != nil {
+			associations = append(associations, dist.DefaultCacheBehavior.FunctionAssociations)
+		}
+		if dist.CacheBehaviors != nil {
+			for _, behavior := range dist.CacheBehaviors.Items {
+				associations = append(associations, behavior.FunctionAssociations)
+			}
+		}
+		for _, a := range associations {
+			if a == nil {
+				continue
+			}
+			for _, item := range a.Items {
+				_, name, _ := strings.Cut(aws.ToString(item.FunctionARN), ":function/")
+				used[name] = true
+			}
+		}
+	}
+
+	functions, err := pm.listPreviewFunctions(ctx)
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	for _, function := range functions {
+		modified := aws.ToTime(function.FunctionMetadata.LastModifiedTime)
+		if used[aws.ToString(function.Name)] || time.Since(modified) < unusedGracePeriod {
+			continue
+		}
+		if err := pm.deleteFunction(ctx, aws.ToString(function.Name)); err != nil {
+			fmt.Fprintf(pm.out, "  Warning: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(pm.out, "  ✓ Deleted %s\n", aws.ToString(function.Name))
+		deleted++
+	}
+
+	fmt.Fprintf(pm.out, "  ✓ %d function(s) deleted\n", deleted)
+	return nil
+}
+
+// listPreviewFunctions returns the viewer-request functions this tool
+// created, once each.
+func (pm *PreviewManager) listPreviewFunctions(ctx context.Context) ([]cftypes.FunctionSummary, error) {
+	var functions []cftypes.FunctionSummary
+	seen := make(map[string]bool)
+
+	input := &cloudfront.ListFunctionsInput{}
+	for {
+		result, err := pm.cfClient.ListFunctions(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list functions: %w", err)
+		}
+
+		list := result.FunctionList
+		if list == nil {
+			return functions, nil
+		}
+		for _, function := range list.Items {
+			name := aws.ToString(function.Name)
+			if !strings.HasPrefix(name, functionPrefix) || seen[name] || function.FunctionMetadata == nil {
+				continue
+			}
+			seen[name] = true
+			functions = append(functions, function)
+		}
+
+		if aws.ToString(list.NextMarker) == "" {
+			return functions, nil
+		}
+		input.Marker = list.NextMarker
+	}
+}
+
+func (pm *PreviewManager) deleteFunction(ctx context.Context, name string) error {
+	function, err := pm.cfClient.DescribeFunction(ctx, &cloudfront.DescribeFunctionInput{
+		Name: aws.String(name),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe function %s: %w", name, err)
+	}
+
+	_, err = pm.cfClient.DeleteFunction(ctx, &cloudfront.DeleteFunctionInput{
+		Name:    aws.String(name),
+		IfMatch: function.ETag,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete function %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// scanMaxFileSize is the largest file searched for secrets. Larger files are
+// still checked against the forbidden file names.
+const scanMaxFileSize = 10 << 20
+
+// secretRule is a pattern for a secret in file contents. Group selects the
+// submatch holding the secret, and MinEntropy rejects matches that do not
+// look random, such as placeholders.
+type secretRule struct {
+	Name       string
+	Pattern    *regexp.Regexp
+	Group      int
+	MinEntropy float64
+}
+
+var secretRules = []secretRule{
+	{Name: "aws-access-key-id", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{
+		Name:    "aws-secret-access-key",
+		Pattern: regexp.MustCompile(`(?i)aws.{0,20}(?:secret|private).{0,20}?['"]([0-9a-zA-Z/+]{40})['"]`),
+		Group:   1,
+	},
+	{Name: "github-token", Pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{Name: "private-key", Pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY-----`)},
+	{
+		Name:       "high-entropy-secret",
+		Pattern:    regexp.MustCompile(`(?i)(?:secret|token|passw(?:or)?d|api[_-]?key|private[_-]?key)["']?\s*[:=]\s*["']([A-Za-z0-9+/=_.\-]{20,})["']`),
+		Group:      1,
+		MinEntropy: 3.5,
+	},
+}
+
+// forbiddenFiles are file name patterns that never belong in a preview.
+var forbiddenFiles = []string{
+	".env", ".env.*", "*.map", "*.pem", "*.key", "*.p12", "*.pfx",
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", ".npmrc", ".htpasswd",
+}
+
+// scanFinding is one secret or forbidden file. Match is redacted, and
+// Fingerprint is keyed, so neither reveals the secret.
+type scanFinding struct {
+	File        string
+	Line        int
+	Rule        string
+	Match       string
+	Fingerprint string
+
+	secret string
+}
+
+// scanError fails a deploy whose source contains sensitive files.
+type scanError struct {
+	Findings []scanFinding
+}
+
+func (e *scanError) Error() string {
+	return fmt.Sprintf("source scan found %d sensitive finding(s)", len(e.Findings))
+}
+
+// scanSource searches the source directory for secrets and forbidden files,
+// prints a redacted report and returns a *scanError when anything is found
+// that is not allowlisted by --scan-allow-path or --scan-allow-fingerprint.
+func (pm *PreviewManager) scanSource(ctx context.Context) error {
+	if !pm.cfg.Scan {
+		return nil
+	}
+
+	fmt.Fprintf(pm.out, "Scanning %s for secrets and sensitive files...\n", pm.cfg.SourcePath)
+
+	var findings []scanFinding
+	err := filepath.WalkDir(pm.cfg.SourcePath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(pm.cfg.SourcePath, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if d.IsDir() || pm.scanAllowed(relPath) {
+			return nil
+		}
+
+		if rule := forbiddenFileRule(relPath); rule != "" {
+			findings = append(findings, scanFinding{
+				File:  relPath,
+				Rule:  rule,
+				Match: path.Base(relPath),
+			})
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() > scanMaxFileSize {
+			return nil
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+		findings = append(findings, scanContent(relPath, data)...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan source directory: %w", err)
+	}
+
+	for i, f := range findings {
+		findings[i].Fingerprint = scanFingerprint(pm.cfg.ScanKey, f.Rule, f.File, f.secret)
+	}
+	findings = slices.DeleteFunc(findings, func(f scanFinding) bool {
+		return slices.Contains(pm.cfg.ScanAllowFingerprints, f.Fingerprint)
+	})
+	if len(findings) == 0 {
+		fmt.Fprintln(pm.out, "  ✓ No secrets or sensitive files found")
+		return nil
+	}
+
+	if err := pm.printScanReport(findings); err != nil {
+		return err
+	}
+	return &scanError{Findings: findings}
+}
+
+// scanAllowed reports whether --scan-allow-path matches the path or its
+// file name.
+func (pm *PreviewManager) scanAllowed(relPath string) bool {
+	for _, pattern := range pm.cfg.ScanAllowPaths {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(relPath)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func forbiddenFileRule(relPath string) string {
+	for _, dir := range strings.Split(path.Dir(relPath), "/") {
+		if dir == ".git" {
+			return "forbidden-file"
+		}
+	}
+	for _, pattern := range forbiddenFiles {
+		if matched, _ := path.Match(pattern, path.Base(relPath)); matched {
+			return "forbidden-file"
+		}
+	}
+	return ""
+}
+
+// scanContent returns the secrets in a text file. Binary files are skipped.
+func scanContent(relPath string, data []byte) []scanFinding {
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil
+	}
+
+	var findings []scanFinding
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		// Rules overlap, e.g. an AWS secret key assigned to "secret", so
+		// each secret is reported once per line.
+		seen := make(map[string]bool)
+		for _, rule := range secretRules {
+			for _, match := range rule.Pattern.FindAllSubmatch(line, -1) {
+				secret := string(match[rule.Group])
+				if seen[secret] || rule.MinEntropy > 0 && !looksRandom(secret, rule.MinEntropy) {
+					continue
+				}
+				seen[secret] = true
+				findings = append(findings, scanFinding{
+					File:   relPath,
+					Line:   i + 1,
+					Rule:   rule.Name,
+					Match:  redact(secret),
+					secret: secret,
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// looksRandom reports whether value has at least minEntropy bits per
+// character and mixes letters and digits, which placeholders such as
+// "your-api-token-goes-here" do not.
+func looksRandom(value string, minEntropy float64) bool {
+	return strings.ContainsAny(value, "0123456789") &&
+		strings.IndexFunc(value, unicode.IsLetter) >= 0 &&
+		shannonEntropy(value) >= minEntropy
+}
+
+// shannonEntropy returns the bits of entropy per character of value.
+func shannonEntropy(value string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range value {
+		counts[r]++
+	}
+
+	var entropy float64
+	length := float64(len([]rune(value)))
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// scanFingerprint identifies a finding for --scan-allow-fingerprint: an HMAC
+// keyed with --scan-key of the rule, the path without content hashes and the
+// secret. It survives rebuilds of hashed and minified bundles but not a
+// different secret, and without the key it cannot confirm a guessed secret.
+// Returns "" without a key.
+func scanFingerprint(key, rule, relPath, secret string) string {
+	if key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\x00%s\x00%s", rule, stripContentHash(relPath), secret)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// stripContentHash removes the content hash bundlers put in file names, as
+// in assets/index-BXk2_3aF.js or static/js/main.3f2a9c1b.js.
+func stripContentHash(relPath string) string {
+	dir, base := path.Split(relPath)
+	parts := strings.Split(base, ".")
+
+	name := parts[0]
+	if i := strings.LastIndex(name, "-"); i > 0 && looksLikeHash(name[i+1:]) {
+		name = name[:i]
+	}
+	kept := []string{name}
+	for i, part := range parts[1:] {
+		// The last part is the extension.
+		if i < len(parts)-2 && looksLikeHash(part) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return dir + strings.Join(kept, ".")
+}
+
+// looksLikeHash reports whether a file name part is a content hash: at least
+// eight letters, digits or underscores, with a digit or mixed case so words
+// such as "polyfill" are kept.
+func looksLikeHash(part string) bool {
+	if len(part) < 8 {
+		return false
+	}
+	var digit, upper, lower bool
+	for _, r := range part {
+		switch {
+		case r >= '0' && r <= '9':
+			digit = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r != '_':
+			return false
+		}
+	}
+	return digit || upper && lower
+}
+
+// redact hides a secret, keeping only its length.
+func redact(secret string) string {
+	return fmt.Sprintf("**** (%d chars)", len(secret))
+}
+
+func (f scanFinding) location() string {
+	if f.Line == 0 {
+		return f.File
+	}
+	return fmt.Sprintf("%s:%d", f.File, f.Line)
+}
+
+func (pm *PreviewManager) printScanReport(findings []scanFinding) error {
+	fmt.Fprintf(pm.out, "  ✗ Found %d secret(s) or sensitive file(s):\n", len(findings))
+	w := newTableWriter(pm.out)
+	fmt.Fprintln(w, "  LOCATION\tRULE\tMATCH\tFINGERPRINT")
+	for _, f := range findings {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", f.location(), f.Rule, f.Match, orDash(f.Fingerprint))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(pm.out, "  Remove them from the build, or allowlist them with --scan-allow-path or --scan-allow-fingerprint")
+	if pm.cfg.ScanKey == "" {
+		fmt.Fprintln(pm.out, "  Set --scan-key (PR_PREVIEW_SCAN_KEY) to get fingerprints")
+	}
+	return nil
+}
+
+// postScanFailedComment tells the PR why the preview was not deployed. It
+// only shows where the findings are and which rule matched; the
+// fingerprints are in the job log.
+func (pm *PreviewManager) postScanFailedComment(ctx context.Context, scanErr *scanError) error {
+	if pm.summarized {
+		return nil
+	}
+	if pm.githubClient == nil {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
+		return nil
+	}
+
+	fmt.Fprintln(pm.out, "Posting GitHub PR comment...")
+
+	var rows []string
+	for _, f := range scanErr.Findings {
+		rows = append(rows, fmt.Sprintf("| `%s` | %s |", f.location(), f.Rule))
+	}
+
+	commentBody := fmt.Sprintf(`## Preview Environment Not Deployed 🔒
+
+The build in `+"`%s`"+` contains secrets or files that must not be published:
+
+| Location | Rule |
+|---|---|
+%s
+
+Remove them from the build, or allowlist a path with `+"`--scan-allow-path`"+` or a finding with `+"`--scan-allow-fingerprint`"+` (the fingerprints are in the job log).`,
+		pm.cfg.SourcePath, strings.Join(rows, "\n"))
+
+	return pm.upsertGitHubComment(ctx, commentBody)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStripContentHash(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"assets/index-BXk2_3aF.js", "assets/index.js"},
+		{"assets/index-3f2a9c1b.js.map", "assets/index.js.map"},
+		{"static/js/main.3f2a9c1b.js", "static/js/main.js"},
+		{"static/js/787.a1b2c3d4.chunk.js", "static/js/787.chunk.js"},
+		{"assets/vendor-polyfill.js", "assets/vendor-polyfill.js"},
+		{"index.html", "index.html"},
+		{".env", ".env"},
+		{".env.production", ".env.production"},
+		{"config.3f2a9c1b", "config.3f2a9c1b"},
+	}
+	for _, tt := range tests {
+		if got := stripContentHash(tt.path); got != tt.want {
+			t.Errorf("stripContentHash(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestScanFingerprint(t *testing.T) {
+	const key = "test-key"
+	secret := "ghp_" + "abcdefghijklmnopqrstuvwxyz0123456789"
+	base := scanFingerprint(key, "github-token", "assets/index-BXk2_3aF.js", secret)
+
+	if len(base) != 16 {
+		t.Fatalf("fingerprint %q has %d characters, want 16", base, len(base))
+	}
+	if got := scanFingerprint(key, "github-token", "assets/index-Zq81_pLm.js", secret); got != base {
+		t.Errorf("fingerprint changed with the content hash: %s != %s", got, base)
+	}
+
+	differs := []struct {
+		name                   string
+		key, rule, path, value string
+	}{
+		{"secret", key, "github-token", "assets/index-BXk2_3aF.js", secret + "x"},
+		{"rule", key, "high-entropy-secret", "assets/index-BXk2_3aF.js", secret},
+		{"path", key, "github-token", "assets/other-BXk2_3aF.js", secret},
+		{"key", "other-key", "github-token", "assets/index-BXk2_3aF.js", secret},
+	}
+	for _, tt := range differs {
+		if got := scanFingerprint(tt.key, tt.rule, tt.path, tt.value); got == base {
+			t.Errorf("fingerprint did not change with the %s", tt.name)
+		}
+	}
+
+	if got := scanFingerprint("", "github-token", "assets/index.js", secret); got != "" {
+		t.Errorf("fingerprint without a key = %q, want empty", got)
+	}
+	if got := sha256Hex(secret)[:16]; got == base {
+		t.Errorf("fingerprint is a plain hash of the secret")
+	}
+}
+
+func TestScanContent(t *testing.T) {
+	awsKey := "AKIA" + "IOSFODNN7EXAMPLE"
+	data := []byte("const a = 1;\n" +
+		"const key = '" + awsKey + "';\n" +
+		"api_key: 'your-api-token-goes-here'\n" +
+		"password = \"Xk9mQ2vL8pR4tW7zN3bH\"\n")
+
+	findings := scanContent("main.js", data)
+
+	want := []struct {
+		line int
+		rule string
+	}{
+		{2, "aws-access-key-id"},
+		{4, "high-entropy-secret"},
+	}
+	if len(findings) != len(want) {
+		t.Fatalf("scanContent() found %d findings, want %d: %+v", len(findings), len(want), findings)
+	}
+	for i, w := range want {
+		f := findings[i]
+		if f.Line != w.line || f.Rule != w.rule {
+			t.Errorf("finding %d = %s %s, want line %d %s", i, f.location(), f.Rule, w.line, w.rule)
+		}
+		if f.Match != redact(f.secret) || f.Match == f.secret {
+			t.Errorf("finding %d match %q is not redacted", i, f.Match)
+		}
+	}
+
+	if got := scanContent("image.png", []byte("\x89PNG\x00"+awsKey)); len(got) != 0 {
+		t.Errorf("scanContent() scanned a binary file: %+v", got)
+	}
+}
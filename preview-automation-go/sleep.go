@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// previewStateTag is set on the bucket while the preview is hibernating.
+const previewStateTag = "preview:state"
+
+// Preview states reported by status.
+const (
+	stateActive      = "active"
+	stateSleeping    = "sleeping"
+	stateDeleting    = "pending deletion"
+	stateNotDeployed = "not deployed"
+)
+
+// Sleep disables the preview distribution while keeping the bucket content,
+// so an idle preview stops serving traffic until it is woken up.
+func (pm *PreviewManager) Sleep(ctx context.Context) error {
+	fmt.Fprintf(pm.out, "Putting preview %s to sleep...\n", pm.bucketName)
+
+	distributionID, err := pm.findCloudFrontDistribution(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find distribution: %w", err)
+	}
+	if distributionID == "" {
+		return fmt.Errorf("no distribution found for %s", pm.fullDomain)
+	}
+
+	changed, err := pm.setDistributionEnabled(ctx, distributionID, false)
+	if err != nil {
+		return fmt.Errorf("failed to disable distribution: %w", err)
+	}
+	if changed {
+		fmt.Fprintln(pm.out, "  ✓ Distribution disabled")
+	} else {
+		fmt.Fprintln(pm.out, "  ✓ Distribution already disabled")
+	}
+
+	err = pm.updateBucketTags(ctx, map[string]string{
+		previewStateTag: stateSleeping,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = pm.updateRecord(ctx, func(r *previewRecord) {
+		r.Status = recordSleeping
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update preview registry: %w", err)
+	}
+
+	if err := pm.postSleepingGitHubComment(ctx); err != nil {
+		fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
+	}
+
+	return nil
+}
+
+// Wake re-enables a sleeping preview.
+func (pm *PreviewManager) Wake(ctx context.Context) error {
+	fmt.Fprintf(pm.out, "Waking preview %s...\n", pm.bucketName)
+
+	distributionID, err := pm.findCloudFrontDistribution(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find distribution: %w", err)
+	}
+	if distributionID == "" {
+		return fmt.Errorf("no distribution found for %s, push a commit to deploy it again", pm.fullDomain)
+	}
+
+	changed, err := pm.setDistributionEnabled(ctx, distributionID, true)
+	if err != nil {
+		return fmt.Errorf("failed to enable distribution: %w", err)
+	}
+	if changed {
+		fmt.Fprintln(pm.out, "  ✓ Distribution enabled")
+	} else {
+		fmt.Fprintln(pm.out, "  ✓ Distribution already enabled")
+	}
+
+	if err := pm.updateBucketTags(ctx, nil, previewStateTag); err != nil {
+		return err
+	}
+
+	err = pm.updateRecord(ctx, func(r *previewRecord) {
+		r.Status = recordActive
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update preview registry: %w", err)
+	}
+
+	if pm.cfg.Wait {
+		if err := pm.waitForDistributionDeployed(ctx, distributionID); err != nil {
+			return fmt.Errorf("preview did not wake up: %w", err)
+		}
+	}
+
+	if err := pm.postGitHubComment(ctx); err != nil {
+		fmt.Fprintf(pm.out, "Warning: Failed to post GitHub comment: %v\n", err)
+	}
+
+	return nil
+}
+
+func (pm *PreviewManager) postSleepingGitHubComment(ctx context.Context) error {
+	if pm.githubClient == nil {
+		fmt.Fprintln(pm.out, "Skipping GitHub comment (no GitHub token provided)")
+		return nil
+	}
+
+	fmt.Fprintln(pm.out, "Posting GitHub PR comment...")
+
+	return pm.upsertGitHubComment(ctx, fmt.Sprintf(`## Preview Environment Sleeping 💤
+
+The preview for **https://%s** is asleep to save cost. Its content is kept.
+
+Comment `+"`/preview wake`"+` to wake it up, or push a new commit to redeploy.`, pm.fullDomain))
+}
+
+// previewStatus is a snapshot of the resources behind a preview.
+type previewStatus struct {
+	State          string
+	Bucket         bool
+	DistributionID string
+	Enabled        bool
+	Deployment     string
+	DNSRecords     []string
+	LastDeployed   string
+	Expiry         *previewExpiry
+}
+
+func (pm *PreviewManager) collectStatus(ctx context.Context) (*previewStatus, error) {
+	status := &previewStatus{}
+
+	_, err := pm.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(pm.bucketName),
+	})
+	status.Bucket = err == nil
+
+	var tags map[string]string
+	if status.Bucket {
+		tags, err = pm.getBucketTags(ctx)
+		if err != nil {
+			return nil, err
+		}
+		status.LastDeployed = tags[lastDeployedTag]
+		status.Expiry = expiryFromTags(tags)
+	}
+
+	status.DistributionID, err = pm.findCloudFrontDistribution(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pendingDeletion := false
+	if status.DistributionID != "" {
+		dist, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+			Id: aws.String(status.DistributionID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get distribution: %w", err)
+		}
+		status.Enabled = aws.ToBool(dist.Distribution.DistributionConfig.Enabled)
+		status.Deployment = aws.ToString(dist.Distribution.Status)
+
+		distTags, err := pm.getDistributionTags(ctx, *dist.Distribution.ARN)
+		if err != nil {
+			return nil, err
+		}
+		_, pendingDeletion = distTags[pendingDeletionTag]
+	}
+
+	hostedZoneID, err := pm.getHostedZoneID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recordSets, err := pm.listPreviewRecordSets(ctx, hostedZoneID)
+	if err != nil {
+		return nil, err
+	}
+	for _, recordSet := range recordSets {
+		status.DNSRecords = append(status.DNSRecords, string(recordSet.Type))
+	}
+
+	switch {
+	case !status.Bucket && status.DistributionID == "":
+		status.State = stateNotDeployed
+	case pendingDeletion:
+		status.State = stateDeleting
+	case tags[previewStateTag] == stateSleeping || (status.DistributionID != "" && !status.Enabled):
+		status.State = stateSleeping
+	default:
+		status.State = stateActive
+	}
+
+	return status, nil
+}
+
+// Status prints the state of the preview and the resources behind it. With a
+// registry configured the registry record is shown instead of querying the
+// resources.
+func (pm *PreviewManager) Status(ctx context.Context) error {
+	if pm.registry != nil {
+		return pm.printRecordStatus(ctx)
+	}
+
+	status, err := pm.collectStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	distribution := "-"
+	if status.DistributionID != "" {
+		enabled := "disabled"
+		if status.Enabled {
+			enabled = "enabled"
+		}
+		distribution = fmt.Sprintf("%s (%s, %s)", status.DistributionID, enabled, status.Deployment)
+	}
+
+	w := newTableWriter(pm.out)
+	fmt.Fprintf(w, "Preview:\t%s\n", pm.bucketName)
+	fmt.Fprintf(w, "URL:\thttps://%s\n", pm.fullDomain)
+	fmt.Fprintf(w, "State:\t%s\n", status.State)
+	fmt.Fprintf(w, "Bucket:\t%t\n", status.Bucket)
+	fmt.Fprintf(w, "Distribution:\t%s\n", distribution)
+	fmt.Fprintf(w, "DNS records:\t%s\n", orDash(strings.Join(status.DNSRecords, ", ")))
+	fmt.Fprintf(w, "Last deployed:\t%s\n", orDash(status.LastDeployed))
+	fmt.Fprintf(w, "Expires:\t%s\n", formatExpiry(status.Expiry))
+	return w.Flush()
+}
+
+func (pm *PreviewManager) printRecordStatus(ctx context.Context) error {
+	record, err := pm.registry.Get(ctx, previewKey{PRNumber: pm.cfg.PRNumber, AppName: pm.cfg.AppName})
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		fmt.Fprintf(pm.out, "Preview %s is not in the registry\n", pm.bucketName)
+		return nil
+	}
+
+	w := newTableWriter(pm.out)
+	fmt.Fprintf(w, "Preview:\t%s\n", pm.bucketName)
+	fmt.Fprintf(w, "URL:\thttps://%s\n", record.Domain)
+	fmt.Fprintf(w, "Status:\t%s\n", record.Status)
+	fmt.Fprintf(w, "Repository:\t%s\n", record.Repo)
+	fmt.Fprintf(w, "SHA:\t%s\n", orDash(record.SHA))
+	fmt.Fprintf(w, "Bucket:\t%s\n", record.BucketName)
+	fmt.Fprintf(w, "Distribution:\t%s\n", orDash(record.DistributionID))
+	fmt.Fprintf(w, "OAC:\t%s\n", orDash(record.OACID))
+	fmt.Fprintf(w, "Hosted zone:\t%s\n", orDash(record.HostedZoneID))
+	fmt.Fprintf(w, "Created:\t%s by %s\n", formatTime(&record.CreatedAt), orDash(record.CreatedBy))
+	fmt.Fprintf(w, "Last deployed:\t%s\n", formatTime(record.LastDeployedAt))
+	fmt.Fprintf(w, "Updated:\t%s\n", formatTime(&record.UpdatedAt))
+	fmt.Fprintf(w, "Deleted:\t%s\n", formatTime(record.DeletedAt))
+	fmt.Fprintf(w, "Expires:\t%s\n", formatExpiry(record.expiry()))
+	return w.Flush()
+}
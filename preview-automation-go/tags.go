@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// repoTag names the owner/repo that deployed a preview, on its bucket and
+// distribution, so gc only collects the previews of its own repository.
+const repoTag = "preview:repo"
+
+// repo returns the owner/repo of the previews, or "" when it is not known.
+func (pm *PreviewManager) repo() string {
+	return repoName(pm.cfg)
+}
+
+func repoName(cfg *Config) string {
+	if cfg.RepoOwner == "" || cfg.RepoName == "" {
+		return ""
+	}
+	return cfg.RepoOwner + "/" + cfg.RepoName
+}
+
+// getBucketTags returns the tags of the preview bucket. A bucket without a
+// tag set yields an empty map.
+func (pm *PreviewManager) getBucketTags(ctx context.Context) (map[string]string, error) {
+	result, err := pm.s3Client.GetBucketTagging(ctx, &s3.GetBucketTaggingInput{
+		Bucket: aws.String(pm.bucketName),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchTagSet" {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("failed to get bucket tags: %w", err)
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range result.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+// updateBucketTags merges set into the bucket tags and drops the keys in
+// remove. S3 replaces the whole tag set, so unrelated tags are read first.
+func (pm *PreviewManager) updateBucketTags(ctx context.Context, set map[string]string, remove ...string) error {
+	tags, err := pm.getBucketTags(ctx)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range set {
+		tags[key] = value
+	}
+	for _, key := range remove {
+		delete(tags, key)
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tagSet := make([]s3types.Tag, 0, len(keys))
+	for _, key := range keys {
+		tagSet = append(tagSet, s3types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tags[key]),
+		})
+	}
+
+	_, err = pm.s3Client.PutBucketTagging(ctx, &s3.PutBucketTaggingInput{
+		Bucket: aws.String(pm.bucketName),
+		Tagging: &s3types.Tagging{
+			TagSet: tagSet,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update bucket tags: %w", err)
+	}
+	return nil
+}
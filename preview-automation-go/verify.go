@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// smokeCheck is a single request made against the live preview.
+type smokeCheck struct {
+	Path       string
+	ExpectHash string
+	Headers    map[string]string
+}
+
+// verifyError lists every smoke check that failed.
+type verifyError struct {
+	Failures []string
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("%d smoke check(s) failed: %s", len(e.Failures), strings.Join(e.Failures, "; "))
+}
+
+// verifyPreview requests the preview URL and the configured extra paths,
+// retrying with backoff while the preview propagates.
+func (pm *PreviewManager) verifyPreview(ctx context.Context) error {
+	fmt.Fprintln(pm.out, "Verifying preview...")
+
+	headers, err := parseHeaderAssertions(pm.cfg.VerifyHeaders)
+	if err != nil {
+		return err
+	}
+
+	root := smokeCheck{Path: "/", Headers: headers}
+	indexHash, err := fileSHA256(filepath.Join(pm.cfg.SourcePath, "index.html"))
+	if err != nil {
+		fmt.Fprintf(pm.out, "  Skipping index.html content check: %v\n", err)
+	} else {
+		root.ExpectHash = indexHash
+	}
+
+	checks := []smokeCheck{root}
+	for _, path := range pm.cfg.VerifyPaths {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		checks = append(checks, smokeCheck{Path: path})
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	var failures []string
+	for _, check := range checks {
+		err := retryWithBackoff(ctx, pm.cfg.VerifyAttempts, 2*time.Second, 30*time.Second, func() error {
+			return pm.runSmokeCheck(ctx, client, check)
+		})
+		if err != nil {
+			fmt.Fprintf(pm.out, "  ✗ %s: %v\n", check.Path, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", check.Path, err))
+			continue
+		}
+		fmt.Fprintf(pm.out, "  ✓ %s\n", check.Path)
+	}
+
+	if len(failures) > 0 {
+		return &verifyError{Failures: failures}
+	}
+	return nil
+}
+
+func (pm *PreviewManager) runSmokeCheck(ctx context.Context, client *http.Client, check smokeCheck) error {
+	url := fmt.Sprintf("https://%s%s", pm.fullDomain, check.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	pm.auth.authenticate(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if isTLSError(err) {
+			return fmt.Errorf("TLS verification failed: %w", err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	for name, want := range check.Headers {
+		got := resp.Header.Get(name)
+		if want == "" && got == "" {
+			return fmt.Errorf("missing header %s", name)
+		}
+		if want != "" && got != want {
+			return fmt.Errorf("header %s is %q, want %q", name, got, want)
+		}
+	}
+
+	if check.ExpectHash != "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, resp.Body); err != nil {
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != check.ExpectHash {
+			return fmt.Errorf("content hash %s does not match uploaded index.html %s", got[:12], check.ExpectHash[:12])
+		}
+	}
+
+	return nil
+}
+
+// parseHeaderAssertions turns "Name: value" flags into a header map. A bare
+// "Name" only asserts that the header is present.
+func parseHeaderAssertions(assertions []string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, assertion := range assertions {
+		name, value, _ := strings.Cut(assertion, ":")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("invalid header assertion %q, expected \"Name: value\"", assertion)
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// retryWithBackoff calls fn up to attempts times, doubling the delay between
+// attempts up to maxDelay.
+func retryWithBackoff(ctx context.Context, attempts int, delay, maxDelay time.Duration, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	return err
+}
+
+func isTLSError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) || errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	waftypes "github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+)
+
+// ensureWebACL returns the ARN of the shared web ACL that only lets the
+// --allow-cidr ranges through, creating it and its IP sets on first use and
+// syncing the IP sets with the configured ranges on every deploy, so a
+// removed range is revoked for every preview at once. Returns "" when no
+// ranges are configured.
+func (pm *PreviewManager) ensureWebACL(ctx context.Context) (string, error) {
+	if len(pm.cfg.AllowCIDRs) == 0 {
+		return "", nil
+	}
+
+	name := pm.cfg.WAFName
+	fmt.Fprintf(pm.out, "Managing WAF allowlist %s...\n", name)
+
+	ipv4, ipv6, err := splitCIDRs(pm.cfg.AllowCIDRs)
+	if err != nil {
+		return "", err
+	}
+
+	ipv4SetARN, err := pm.ensureIPSet(ctx, name+"-ipv4", waftypes.IPAddressVersionIpv4, ipv4)
+	if err != nil {
+		return "", err
+	}
+	ipv6SetARN, err := pm.ensureIPSet(ctx, name+"-ipv6", waftypes.IPAddressVersionIpv6, ipv6)
+	if err != nil {
+		return "", err
+	}
+
+	acl, err := pm.findWebACL(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if acl != nil {
+		fmt.Fprintln(pm.out, "  ✓ Using existing web ACL")
+		return aws.ToString(acl.ARN), nil
+	}
+
+	result, err := pm.wafClient.CreateWebACL(ctx, &wafv2.CreateWebACLInput{
+		Name:          aws.String(name),
+		Scope:         waftypes.ScopeCloudfront,
+		Description:   aws.String("Only allows the PR preview IP allowlist"),
+		DefaultAction: &waftypes.DefaultAction{Block: &waftypes.BlockAction{}},
+		Rules: []waftypes.Rule{
+			allowIPSetRule("allow-ipv4", 0, ipv4SetARN),
+			allowIPSetRule("allow-ipv6", 1, ipv6SetARN),
+		},
+		VisibilityConfig: visibilityConfig(name),
+	})
+	var duplicate *waftypes.WAFDuplicateItemException
+	if errors.As(err, &duplicate) {
+		// Another deploy created it in the meantime.
+		acl, err = pm.findWebACL(ctx, name)
+		if err != nil || acl == nil {
+			return "", fmt.Errorf("failed to find web ACL: %w", err)
+		}
+		return aws.ToString(acl.ARN), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create web ACL: %w", err)
+	}
+
+	fmt.Fprintln(pm.out, "  ✓ Web ACL created")
+	return aws.ToString(result.Summary.ARN), nil
+}
+
+func allowIPSetRule(name string, priority int32, ipSetARN string) waftypes.Rule {
+	return waftypes.Rule{
+		Name:     aws.String(name),
+		Priority: priority,
+		Action:   &waftypes.RuleAction{Allow: &waftypes.AllowAction{}},
+		Statement: &waftypes.Statement{
+			IPSetReferenceStatement: &waftypes.IPSetReferenceStatement{ARN: aws.String(ipSetARN)},
+		},
+		VisibilityConfig: visibilityConfig(name),
+	}
+}
+
+func visibilityConfig(metricName string) *waftypes.VisibilityConfig {
+	return &waftypes.VisibilityConfig{
+		CloudWatchMetricsEnabled: true,
+		MetricName:               aws.String(metricName),
+		SampledRequestsEnabled:   true,
+	}
+}
+
+// ensureIPSet creates the IP set or updates its addresses to match.
+func (pm *PreviewManager) ensureIPSet(ctx context.Context, name string, version waftypes.IPAddressVersion, addresses []string) (string, error) {
+	summary, err := pm.findIPSet(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	if summary == nil {
+		result, err := pm.wafClient.CreateIPSet(ctx, &wafv2.CreateIPSetInput{
+			Name:             aws.String(name),
+			Scope:            waftypes.ScopeCloudfront,
+			IPAddressVersion: version,
+			Addresses:        addresses,
+			Description:      aws.String("PR preview IP allowlist"),
+		})
+		var duplicate *waftypes.WAFDuplicateItemException
+		switch {
+		case errors.As(err, &duplicate):
+			// Another deploy created it in the meantime, possibly with other
+			// ranges, so sync it below.
+			summary, err = pm.findIPSet(ctx, name)
+			if err != nil || summary == nil {
+				return "", fmt.Errorf("failed to find IP set %s: %w", name, err)
+			}
+		case err != nil:
+			return "", fmt.Errorf("failed to create IP set %s: %w", name, err)
+		default:
+			fmt.Fprintf(pm.out, "  ✓ IP set %s created (%d range(s))\n", name, len(addresses))
+			return aws.ToString(result.Summary.ARN), nil
+		}
+	}
+
+	// Another deploy may update the set concurrently; WAF rejects stale lock
+	// tokens, so re-read and retry.
+	for attempt := 1; ; attempt++ {
+		current, err := pm.wafClient.GetIPSet(ctx, &wafv2.GetIPSetInput{
+			Id:    summary.Id,
+			Name:  summary.Name,
+			Scope: waftypes.ScopeCloudfront,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get IP set %s: %w", name, err)
+		}
+
+		existing := slices.Clone(current.IPSet.Addresses)
+		sort.Strings(existing)
+		if slices.Equal(existing, addresses) {
+			return aws.ToString(summary.ARN), nil
+		}
+
+		_, err = pm.wafClient.UpdateIPSet(ctx, &wafv2.UpdateIPSetInput{
+			Id:        summary.Id,
+			Name:      summary.Name,
+			Scope:     waftypes.ScopeCloudfront,
+			Addresses: addresses,
+			LockToken: current.LockToken,
+		})
+		var stale *waftypes.WAFOptimisticLockException
+		if errors.As(err, &stale) && attempt < pm.cfg.MaxAttempts {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to update IP set %s: %w", name, err)
+		}
+
+		fmt.Fprintf(pm.out, "  ✓ IP set %s updated (%d range(s))\n", name, len(addresses))
+		return aws.ToString(summary.ARN), nil
+	}
+}
+
+func (pm *PreviewManager) findIPSet(ctx context.Context, name string) (*waftypes.IPSetSummary, error) {
+	input := &wafv2.ListIPSetsInput{Scope: waftypes.ScopeCloudfront}
+	for {
+		result, err := pm.wafClient.ListIPSets(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list IP sets: %w", err)
+		}
+		for _, ipSet := range result.IPSets {
+			if aws.ToString(ipSet.Name) == name {
+				return &ipSet, nil
+			}
+		}
+		if aws.ToString(result.NextMarker) == "" || len(result.IPSets) == 0 {
+			return nil, nil
+		}
+		input.NextMarker = result.NextMarker
+	}
+}
+
+func (pm *PreviewManager) findWebACL(ctx context.Context, name string) (*waftypes.WebACLSummary, error) {
+	input := &wafv2.ListWebACLsInput{Scope: waftypes.ScopeCloudfront}
+	for {
+		result, err := pm.wafClient.ListWebACLs(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list web ACLs: %w", err)
+		}
+		for _, acl := range result.WebACLs {
+			if aws.ToString(acl.Name) == name {
+				return &acl, nil
+			}
+		}
+		if aws.ToString(result.NextMarker) == "" || len(result.WebACLs) == 0 {
+			return nil, nil
+		}
+		input.NextMarker = result.NextMarker
+	}
+}
+
+// splitCIDRs validates the ranges and splits them by IP version, sorted and
+// in canonical form.
+func splitCIDRs(cidrs []string) ([]string, []string, error) {
+	ipv4, ipv6 := []string{}, []string{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		if network.IP.To4() != nil {
+			ipv4 = append(ipv4, network.String())
+		} else {
+			ipv6 = append(ipv6, network.String())
+		}
+	}
+	sort.Strings(ipv4)
+	sort.Strings(ipv6)
+	return slices.Compact(ipv4), slices.Compact(ipv6), nil
+}
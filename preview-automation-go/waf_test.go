@@ -0,0 +1,58 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitCIDRs(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidrs    []string
+		wantIPv4 []string
+		wantIPv6 []string
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			wantIPv4: []string{},
+			wantIPv6: []string{},
+		},
+		{
+			name:     "split, sorted and canonical",
+			cidrs:    []string{"2001:DB8::1/32", "10.1.2.3/8", "192.168.0.0/16"},
+			wantIPv4: []string{"10.0.0.0/8", "192.168.0.0/16"},
+			wantIPv6: []string{"2001:db8::/32"},
+		},
+		{
+			name:     "duplicates after canonicalization",
+			cidrs:    []string{"10.0.0.1/8", "10.0.0.0/8"},
+			wantIPv4: []string{"10.0.0.0/8"},
+			wantIPv6: []string{},
+		},
+		{
+			name:    "missing prefix length",
+			cidrs:   []string{"10.0.0.1"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			cidrs:   []string{"vpn"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipv4, ipv6, err := splitCIDRs(tt.cidrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitCIDRs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !slices.Equal(ipv4, tt.wantIPv4) || !slices.Equal(ipv6, tt.wantIPv6) {
+				t.Errorf("splitCIDRs() = %q, %q, want %q, %q", ipv4, ipv6, tt.wantIPv4, tt.wantIPv6)
+			}
+		})
+	}
+}
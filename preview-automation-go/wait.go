@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// waitForPreview blocks until the DNS change, the distribution and the cache
+// invalidation have all propagated, so the preview is actually serving.
+func (pm *PreviewManager) waitForPreview(ctx context.Context, distributionID, invalidationID, changeID string) error {
+	fmt.Fprintln(pm.out, "Waiting for preview to go live...")
+
+	if changeID != "" {
+		if err := pm.waitForDNSChange(ctx, changeID); err != nil {
+			return err
+		}
+	}
+
+	if err := pm.waitForDistributionDeployed(ctx, distributionID); err != nil {
+		return err
+	}
+
+	if invalidationID != "" {
+		if err := pm.waitForInvalidation(ctx, distributionID, invalidationID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pm *PreviewManager) waitForDNSChange(ctx context.Context, changeID string) error {
+	return pm.pollUntil(ctx, "DNS change to reach INSYNC", pm.cfg.DNSTimeout, 10*time.Second, func(ctx context.Context) (bool, string, error) {
+		result, err := pm.r53Client.GetChange(ctx, &route53.GetChangeInput{
+			Id: aws.String(changeID),
+		})
+		if err != nil {
+			return false, "", fmt.Errorf("failed to get DNS change: %w", err)
+		}
+		status := result.ChangeInfo.Status
+		return status == r53types.ChangeStatusInsync, string(status), nil
+	})
+}
+
+func (pm *PreviewManager) waitForDistributionDeployed(ctx context.Context, distributionID string) error {
+	return pm.pollUntil(ctx, "distribution to be deployed", pm.cfg.DeployTimeout, 20*time.Second, func(ctx context.Context) (bool, string, error) {
+		result, err := pm.cfClient.GetDistribution(ctx, &cloudfront.GetDistributionInput{
+			Id: aws.String(distributionID),
+		})
+		if err != nil {
+			return false, "", fmt.Errorf("failed to get distribution: %w", err)
+		}
+		status := aws.ToString(result.Distribution.Status)
+		return status == "Deployed", status, nil
+	})
+}
+
+func (pm *PreviewManager) waitForInvalidation(ctx context.Context, distributionID, invalidationID string) error {
+	return pm.pollUntil(ctx, "cache invalidation to complete", pm.cfg.InvalidationTimeout, 10*time.Second, func(ctx context.Context) (bool, string, error) {
+		result, err := pm.cfClient.GetInvalidation(ctx, &cloudfront.GetInvalidationInput{
+			DistributionId: aws.String(distributionID),
+			Id:             aws.String(invalidationID),
+		})
+		if err != nil {
+			return false, "", fmt.Errorf("failed to get invalidation: %w", err)
+		}
+		status := aws.ToString(result.Invalidation.Status)
+		return status == "Completed", status, nil
+	})
+}
+
+// pollUntil calls check every interval until it reports done or timeout
+// elapses, printing the last observed status so long waits show progress.
+func (pm *PreviewManager) pollUntil(ctx context.Context, what string, timeout, interval time.Duration, check func(context.Context) (bool, string, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	status := "unknown"
+	for {
+		done, current, err := check(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("timed out after %s waiting for %s (last status: %s)", timeout, what, status)
+			}
+			return err
+		}
+		status = current
+
+		elapsed := time.Since(start).Round(time.Second)
+		if done {
+			fmt.Fprintf(pm.out, "  ✓ Done waiting for %s (%s)\n", what, elapsed)
+			return nil
+		}
+		fmt.Fprintf(pm.out, "  Waiting for %s: %s (%s elapsed)\n", what, status, elapsed)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s waiting for %s (last status: %s)", timeout, what, status)
+		case <-ticker.C:
+		}
+	}
+}